@@ -0,0 +1,8 @@
+module github.com/BellaLi/azure-relay-GO
+
+go 1.21
+
+require (
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+)
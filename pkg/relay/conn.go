@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Addr is the network address of a hybrid connection.
+type Addr struct {
+	NS   string
+	Path string
+}
+
+// Network returns the name of the network, "relay".
+func (a *Addr) Network() string { return "relay" }
+
+func (a *Addr) String() string { return "sb://" + a.NS + "/" + a.Path }
+
+// String returns the endpoint in host:port form.
+func (e RemoteEndpoint) String() string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(int(e.Port)))
+}
+
+func (e RemoteEndpoint) addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(e.Address), Port: int(e.Port)}
+}
+
+// wsConn is a net.Conn reading and writing the messages of a relayed websocket as a byte stream.
+type wsConn struct {
+	ws     *websocket.Conn
+	local  net.Addr
+	remote net.Addr
+
+	frame *AcceptFrame
+
+	rmu sync.Mutex
+	r   io.Reader
+
+	wmu sync.Mutex
+
+	closeOnce sync.Once
+	endOnce   sync.Once
+	onClose   func()
+}
+
+func newWSConn(ws *websocket.Conn, local, remote net.Addr, onClose func()) *wsConn {
+	return &wsConn{ws: ws, local: local, remote: remote, onClose: onClose}
+}
+
+// AcceptFrameOf returns the accept frame of a connection returned by Listener.Accept.
+func AcceptFrameOf(c net.Conn) (*AcceptFrame, bool) {
+	wc, ok := c.(*wsConn)
+	if !ok || wc.frame == nil {
+		return nil, false
+	}
+	return wc.frame, true
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		if c.r == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				// the connection is over, whether or not it gets closed
+				c.ended()
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			// the message is exhausted, continue with the next one
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame to the peer and closes the underlying websocket.
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.wmu.Lock()
+		c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.wmu.Unlock()
+
+		err = c.ws.Close()
+		c.ended()
+	})
+	return err
+}
+
+// ended runs onClose once the connection is closed or its peer is gone.
+func (c *wsConn) ended() {
+	c.endOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *wsConn) LocalAddr() net.Addr { return c.local }
+
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error { return c.ws.SetReadDeadline(t) }
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ConnectionString holds the settings of an Azure Relay connection string, such as
+//
+//	Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessKeyName=managepolicy;SharedAccessKey=...;EntityPath=yesclientauth
+//
+// or, with a pre-issued token,
+//
+//	Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessSignature=SharedAccessSignature sr=...;EntityPath=yesclientauth
+type ConnectionString struct {
+	Endpoint              string
+	NS                    string
+	SharedAccessKeyName   string
+	SharedAccessKey       string
+	SharedAccessSignature string
+	EntityPath            string
+}
+
+// ParseConnectionString parses and validates an Azure Relay connection string.
+func ParseConnectionString(s string) (*ConnectionString, error) {
+	cs := &ConnectionString{}
+	fields := map[string]*string{
+		"endpoint":              &cs.Endpoint,
+		"sharedaccesskeyname":   &cs.SharedAccessKeyName,
+		"sharedaccesskey":       &cs.SharedAccessKey,
+		"sharedaccesssignature": &cs.SharedAccessSignature,
+		"entitypath":            &cs.EntityPath,
+	}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// values such as base64 keys and signatures may contain '='
+		i := strings.Index(part, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("relay: connection string: %q is not a key=value pair", part)
+		}
+		key, value := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+
+		field, ok := fields[strings.ToLower(key)]
+		if !ok {
+			return nil, fmt.Errorf("relay: connection string: unknown key %q", key)
+		}
+		if seen[strings.ToLower(key)] {
+			return nil, fmt.Errorf("relay: connection string: duplicate key %q", key)
+		}
+		seen[strings.ToLower(key)] = true
+		*field = value
+	}
+
+	if cs.Endpoint == "" {
+		return nil, fmt.Errorf("relay: connection string: missing Endpoint")
+	}
+	u, err := url.Parse(cs.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("relay: connection string: invalid Endpoint %q: %v", cs.Endpoint, err)
+	}
+	if u.Scheme != "sb" || u.Host == "" {
+		return nil, fmt.Errorf("relay: connection string: Endpoint %q must look like sb://<namespace>.servicebus.windows.net/", cs.Endpoint)
+	}
+	cs.NS = u.Host
+
+	switch {
+	case cs.SharedAccessSignature != "":
+		if cs.SharedAccessKeyName != "" || cs.SharedAccessKey != "" {
+			return nil, fmt.Errorf("relay: connection string: SharedAccessSignature cannot be combined with SharedAccessKeyName or SharedAccessKey")
+		}
+		if !strings.HasPrefix(cs.SharedAccessSignature, "SharedAccessSignature ") {
+			return nil, fmt.Errorf("relay: connection string: SharedAccessSignature must start with \"SharedAccessSignature \"")
+		}
+	case cs.SharedAccessKeyName == "" && cs.SharedAccessKey == "":
+		return nil, fmt.Errorf("relay: connection string: missing SharedAccessKeyName and SharedAccessKey, or SharedAccessSignature")
+	case cs.SharedAccessKeyName == "":
+		return nil, fmt.Errorf("relay: connection string: missing SharedAccessKeyName")
+	case cs.SharedAccessKey == "":
+		return nil, fmt.Errorf("relay: connection string: missing SharedAccessKey")
+	}
+
+	return cs, nil
+}
+
+func (cs *ConnectionString) entityPath() (string, error) {
+	path := strings.Trim(cs.EntityPath, "/")
+	if path == "" {
+		return "", fmt.Errorf("relay: connection string: missing EntityPath")
+	}
+	return path, nil
+}
+
+// NewListener returns a listener for the hybrid connection named by the EntityPath of a connection string.
+func NewListener(connectionString string) (*Listener, error) {
+	cs, err := ParseConnectionString(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	path, err := cs.entityPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{
+		NS:                    cs.NS,
+		Path:                  path,
+		Keyrule:               cs.SharedAccessKeyName,
+		Key:                   cs.SharedAccessKey,
+		SharedAccessSignature: cs.SharedAccessSignature,
+	}, nil
+}
+
+// NewSender returns a sender for the hybrid connection named by the EntityPath of a connection string.
+func NewSender(connectionString string) (*Sender, error) {
+	cs, err := ParseConnectionString(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	path, err := cs.entityPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sender{
+		NS:                    cs.NS,
+		Path:                  path,
+		Keyrule:               cs.SharedAccessKeyName,
+		Key:                   cs.SharedAccessKey,
+		SharedAccessSignature: cs.SharedAccessSignature,
+		ClientAuthRequired:    true,
+	}, nil
+}
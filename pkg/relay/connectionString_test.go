@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	const sas = "SharedAccessSignature sr=http%3a%2f%2fns%2fhc&sig=a%2bb%3d&se=1&skn=rule"
+	tests := []struct {
+		in   string
+		want *ConnectionString
+		err  string
+	}{
+		{"Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=rule;SharedAccessKey=a+b/c==;EntityPath=hc",
+			&ConnectionString{Endpoint: "sb://ns.servicebus.windows.net/", NS: "ns.servicebus.windows.net", SharedAccessKeyName: "rule", SharedAccessKey: "a+b/c==", EntityPath: "hc"}, ""},
+		{"Endpoint=sb://ns/;SharedAccessSignature=" + sas + ";EntityPath=hc",
+			&ConnectionString{Endpoint: "sb://ns/", NS: "ns", SharedAccessSignature: sas, EntityPath: "hc"}, ""},
+		{" endpoint = sb://ns/ ; SHAREDACCESSKEYNAME=rule;sharedAccessKey=key; ",
+			&ConnectionString{Endpoint: "sb://ns/", NS: "ns", SharedAccessKeyName: "rule", SharedAccessKey: "key"}, ""},
+		{"Endpoint=sb://ns:5671;SharedAccessKeyName=rule;SharedAccessKey=key",
+			&ConnectionString{Endpoint: "sb://ns:5671", NS: "ns:5671", SharedAccessKeyName: "rule", SharedAccessKey: "key"}, ""},
+		{"Endpoint=sb://ns/;SharedAccessKeyName=rule;SharedAccessKey=key;endpoint=sb://other/", nil, `duplicate key "endpoint"`},
+		{"Endpoint=sb://ns/;SharedAccessKeyName=rule;SharedAccessKey=key;TransportType=Amqp", nil, `unknown key "TransportType"`},
+		{"Endpoint=sb://ns/;SharedAccessKeyName;SharedAccessKey=key", nil, "not a key=value pair"},
+		{"Endpoint=sb://ns/;=rule;SharedAccessKey=key", nil, "not a key=value pair"},
+		{"Endpoint=https://ns/;SharedAccessKeyName=rule;SharedAccessKey=key", nil, "must look like sb://"},
+		{"Endpoint=ns.servicebus.windows.net;SharedAccessKeyName=rule;SharedAccessKey=key", nil, "must look like sb://"},
+		{"Endpoint=sb://%zz/;SharedAccessKeyName=rule;SharedAccessKey=key", nil, "invalid Endpoint"},
+		{"SharedAccessKeyName=rule;SharedAccessKey=key", nil, "missing Endpoint"},
+		{"Endpoint=sb://ns/;SharedAccessSignature=" + sas + ";SharedAccessKey=key", nil, "cannot be combined"},
+		{"Endpoint=sb://ns/;SharedAccessSignature=" + sas + ";SharedAccessKeyName=rule", nil, "cannot be combined"},
+		{"Endpoint=sb://ns/;SharedAccessSignature=sr=a&sig=b", nil, `must start with "SharedAccessSignature "`},
+		{"Endpoint=sb://ns/", nil, "missing SharedAccessKeyName and SharedAccessKey, or SharedAccessSignature"},
+		{"Endpoint=sb://ns/;SharedAccessKey=key", nil, "missing SharedAccessKeyName"},
+		{"Endpoint=sb://ns/;SharedAccessKeyName=rule", nil, "missing SharedAccessKey"},
+		{"", nil, "missing Endpoint"},
+	}
+	for _, tt := range tests {
+		got, err := ParseConnectionString(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseConnectionString(%q) error = %v, want it to contain %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseConnectionString(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseConnectionString(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewListenerSender(t *testing.T) {
+	const cs = "Endpoint=sb://ns/;SharedAccessKeyName=rule;SharedAccessKey=key;EntityPath=/hc/"
+	l, err := NewListener(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.NS != "ns" || l.Path != "hc" || l.Keyrule != "rule" || l.Key != "key" {
+		t.Errorf("NewListener = %+v", l)
+	}
+	s, err := NewSender(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NS != "ns" || s.Path != "hc" || s.Keyrule != "rule" || s.Key != "key" {
+		t.Errorf("NewSender = %+v", s)
+	}
+
+	for _, cs := range []string{
+		"Endpoint=sb://ns/;SharedAccessKeyName=rule;SharedAccessKey=key",
+		"Endpoint=sb://ns/;SharedAccessKeyName=rule;SharedAccessKey=key;EntityPath=/",
+	} {
+		if _, err := NewListener(cs); err == nil || !strings.Contains(err.Error(), "missing EntityPath") {
+			t.Errorf("NewListener(%q) error = %v, want missing EntityPath", cs, err)
+		}
+		if _, err := NewSender(cs); err == nil || !strings.Contains(err.Error(), "missing EntityPath") {
+			t.Errorf("NewSender(%q) error = %v, want missing EntityPath", cs, err)
+		}
+	}
+}
@@ -0,0 +1,659 @@
+// Package emulator provides an in-process Azure Relay namespace speaking the hybrid connection
+// protocol, so that listeners and senders can be run end to end without a network.
+//
+// The emulator serves TLS on a local port. Its Dialer and Transport route every relay host to it:
+//
+//	s := &emulator.Server{Keys: map[string]string{"rule": "key"}}
+//	s.Start()
+//	defer s.Close()
+//
+//	l := &relay.Listener{NS: "ns", Path: "hc", Keyrule: "rule", Key: "key", Dialer: s.Dialer()}
+//	snd := &relay.Sender{NS: "ns", Path: "hc", Keyrule: "rule", Key: "key", ClientAuthRequired: true,
+//		Dialer: s.Dialer(), Transport: s.Transport()}
+//
+// Listeners and senders can also name the emulator in their Endpoint, set to s.URL, in which
+// case the Dialer and Transport only serve to trust its certificate.
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxControlMessageSize is the size of the largest request body sent on the control channel.
+	// Larger requests go through a rendezvous websocket.
+	maxControlMessageSize = 64 * 1024
+
+	defaultTimeout = 30 * time.Second
+
+	// certHost is the host name the certificate of httptest servers is issued for.
+	certHost = "example.com"
+
+	// noListener is the description of the relay when no listener is connected.
+	noListener = "There are no listeners connected for the endpoint."
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+// Server is an emulated relay namespace. Its hybrid connections exist as soon as a listener
+// connects to them.
+type Server struct {
+	// Keys maps the names of the shared access keys of the namespace to the keys. Tokens are
+	// validated against them. If empty, any token is accepted.
+	Keys map[string]string
+
+	// ClientAuthRequired reports whether senders must present a token too.
+	ClientAuthRequired bool
+
+	// MaxListeners is the number of control channels a hybrid connection accepts. Further ones
+	// are refused with 403 Forbidden for exceeding the quota. If zero, there is no limit.
+	MaxListeners int
+
+	// Timeout is how long a sender waits for the listener to answer. If zero, 30 seconds.
+	Timeout time.Duration
+
+	// URL is the base URL of the server, https://127.0.0.1:<port>. It is set by Start.
+	URL string
+
+	srv *httptest.Server
+
+	listenMu sync.Mutex
+
+	mu        sync.Mutex
+	listeners map[string][]*controlChannel
+	next      int
+	accepts   map[string]chan *acceptance
+	requests  map[string]*pendingRequest
+}
+
+// Start starts serving on a local port.
+func (s *Server) Start() {
+	s.listeners = make(map[string][]*controlChannel)
+	s.accepts = make(map[string]chan *acceptance)
+	s.requests = make(map[string]*pendingRequest)
+
+	s.srv = httptest.NewTLSServer(s)
+	s.URL = s.srv.URL
+}
+
+// Close closes the control channels and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, channels := range s.listeners {
+		for _, ch := range channels {
+			ch.close(websocket.CloseGoingAway, "server shutting down")
+		}
+	}
+	s.mu.Unlock()
+
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.srv.Listener.Addr().String()
+}
+
+// Dialer returns a websocket dialer connecting to the server whatever the host dialed.
+func (s *Server) Dialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.NetDialContext = s.dialContext
+	d.TLSClientConfig = s.tlsConfig()
+	return &d
+}
+
+// Transport returns an HTTP transport connecting to the server whatever the host requested.
+func (s *Server) Transport() *http.Transport {
+	t := s.srv.Client().Transport.(*http.Transport).Clone()
+	t.DialContext = s.dialContext
+	t.TLSClientConfig = s.tlsConfig()
+	return t
+}
+
+func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr())
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	c := s.srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	c.ServerName = certHost
+	return c
+}
+
+// NumListeners returns the number of control channels connected to the hybrid connection path.
+func (s *Server) NumListeners(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.listeners[strings.Trim(path, "/")])
+}
+
+// ServeHTTP serves the hybrid connection protocol on /$hc/<path> and relays the other requests
+// to the listeners of the hybrid connection their path starts with.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.Path, "/$hc/")
+	if !ok {
+		s.serveRequest(w, r)
+		return
+	}
+	path = strings.Trim(path, "/")
+
+	q := r.URL.Query()
+	switch q.Get("sb-hc-action") {
+	case "listen":
+		s.serveListen(w, r, path)
+	case "accept":
+		s.serveAccept(w, r, q.Get("sb-hc-id"))
+	case "connect":
+		s.serveConnect(w, r, path)
+	case "request":
+		s.serveRendezvous(w, r, q.Get("sb-hc-id"))
+	default:
+		relayError(w, r, "unknown sb-hc-action", http.StatusBadRequest)
+	}
+}
+
+// controlChannel is the control channel of a listener.
+type controlChannel struct {
+	id   string
+	path string
+	host string
+	ws   *websocket.Conn
+
+	wmu    sync.Mutex
+	expiry *time.Timer
+}
+
+// send writes a control frame and its body to the listener.
+func (ch *controlChannel) send(f relay.Frame, body []byte) error {
+	b, err := relay.EncodeFrame(f)
+	if err != nil {
+		return err
+	}
+
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	if err := ch.ws.WriteMessage(websocket.TextMessage, b); err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return ch.ws.WriteMessage(websocket.BinaryMessage, body)
+}
+
+func (ch *controlChannel) close(code int, text string) {
+	ch.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	ch.ws.Close()
+}
+
+// expireAt drops the control channel when its token expires, unless renewed by then.
+func (ch *controlChannel) expireAt(t time.Time) {
+	if ch.expiry != nil {
+		ch.expiry.Stop()
+	}
+	if t.IsZero() {
+		return
+	}
+	ch.expiry = time.AfterFunc(time.Until(t), func() { ch.close(websocket.ClosePolicyViolation, "token expired") })
+}
+
+// address returns the rendezvous address for action and id, on the host the listener dialed.
+func (ch *controlChannel) address(action, id string) string {
+	return relay.RelayURI{NS: ch.host, Path: ch.path, Action: action, ID: id}.String()
+}
+
+func (s *Server) serveListen(w http.ResponseWriter, r *http.Request, path string) {
+	expiry, err := s.authorize(r, path)
+	if err != nil {
+		relayError(w, r, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// the quota is checked and the channel added at once, so that parallel dials cannot exceed it
+	s.listenMu.Lock()
+	if s.MaxListeners > 0 && s.NumListeners(path) >= s.MaxListeners {
+		s.listenMu.Unlock()
+		relayError(w, r, fmt.Sprintf("Quota exceeded: the hybrid connection has the maximum of %d listeners.", s.MaxListeners), http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.listenMu.Unlock()
+		return
+	}
+	ch := &controlChannel{id: r.URL.Query().Get("sb-hc-id"), path: path, host: r.Host, ws: ws}
+	ch.expireAt(expiry)
+
+	s.mu.Lock()
+	s.listeners[path] = append(s.listeners[path], ch)
+	s.mu.Unlock()
+	s.listenMu.Unlock()
+
+	defer func() {
+		ch.expireAt(time.Time{})
+		ws.Close()
+
+		s.mu.Lock()
+		channels := s.listeners[path]
+		for i, c := range channels {
+			if c == ch {
+				s.listeners[path] = append(channels[:i:i], channels[i+1:]...)
+				break
+			}
+		}
+		if len(s.listeners[path]) == 0 {
+			delete(s.listeners, path)
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		mt, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt != websocket.TextMessage {
+			ch.close(websocket.CloseUnsupportedData, "unexpected binary message")
+			return
+		}
+
+		frame, err := relay.DecodeFrame(message)
+		if err != nil {
+			ch.close(websocket.CloseUnsupportedData, err.Error())
+			return
+		}
+
+		switch f := frame.(type) {
+		case *relay.RenewTokenFrame:
+			expiry, err := s.validateToken(f.Token, r.Host, path)
+			if err != nil {
+				ch.close(websocket.ClosePolicyViolation, err.Error())
+				return
+			}
+			ch.expireAt(expiry)
+
+		case *relay.ResponseFrame:
+			var body []byte
+			if f.Body {
+				if _, body, err = ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+			s.respond(f, bytes.NewReader(body), nil)
+		}
+	}
+}
+
+// pickListener returns the next control channel of the hybrid connection, or nil if no
+// listener is connected.
+func (s *Server) pickListener(path string) *controlChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := s.listeners[path]
+	if len(channels) == 0 {
+		return nil
+	}
+	s.next++
+	return channels[s.next%len(channels)]
+}
+
+// route returns the hybrid connection a request path goes to.
+func (s *Server) route(p string) (string, bool) {
+	p = strings.Trim(p, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := ""
+	for path := range s.listeners {
+		if (p == path || strings.HasPrefix(p, path+"/")) && len(path) > len(best) {
+			best = path
+		}
+	}
+	return best, best != ""
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultTimeout
+}
+
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request, path string) {
+	if s.ClientAuthRequired {
+		if _, err := s.authorize(r, path); err != nil {
+			relayError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ch := s.pickListener(path)
+	if ch == nil {
+		relayError(w, r, noListener, http.StatusNotFound)
+		return
+	}
+
+	id := uuid.New().String()
+	accepted := make(chan *acceptance, 1)
+	s.mu.Lock()
+	s.accepts[id] = accepted
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.accepts, id)
+		s.mu.Unlock()
+	}()
+
+	err := ch.send(&relay.AcceptFrame{
+		ID:             id,
+		Address:        ch.address(relay.ActionAccept, id),
+		ConnectHeaders: connectHeaders(r),
+		RemoteEndpoint: remoteEndpoint(r),
+	}, nil)
+	if err != nil {
+		relayError(w, r, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var a *acceptance
+	select {
+	case a = <-accepted:
+	case <-time.After(s.timeout()):
+		relayError(w, r, "listener did not accept", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	if a.ws == nil {
+		relayError(w, r, a.description, a.status)
+		return
+	}
+
+	sws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		a.ws.Close()
+		return
+	}
+	go pipe(a.ws, sws)
+	pipe(sws, a.ws)
+}
+
+// acceptance is the answer of a listener to a connection: its rendezvous websocket, or the
+// status it rejected the connection with.
+type acceptance struct {
+	ws          *websocket.Conn
+	status      int
+	description string
+}
+
+func (s *Server) serveAccept(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	accepted, ok := s.accepts[id]
+	delete(s.accepts, id)
+	s.mu.Unlock()
+	if !ok {
+		relayError(w, r, "no pending connection "+id, http.StatusNotFound)
+		return
+	}
+
+	// the listener rejects the connection by naming a status instead of upgrading
+	q := r.URL.Query()
+	if code := q.Get("sb-hc-statusCode"); code != "" {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			status = http.StatusBadRequest
+		}
+		accepted <- &acceptance{status: status, description: q.Get("sb-hc-statusDescription")}
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	accepted <- &acceptance{ws: ws}
+}
+
+// relayError answers an error of the relay. Like Azure Relay, the description ends with a
+// tracking id, which tells senders the error is not a response of the listener.
+func relayError(w http.ResponseWriter, r *http.Request, description string, code int) {
+	http.Error(w, fmt.Sprintf("%s TrackingId:%s, SystemTracker:%s%s, Timestamp:%s",
+		description, uuid.New(), r.Host, r.URL.Path, time.Now().UTC().Format(time.RFC3339)), code)
+}
+
+// pipe copies the messages of src to dst until src closes, then closes dst with the same code.
+func pipe(dst, src *websocket.Conn) {
+	defer dst.Close()
+	for {
+		mt, message, err := src.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure {
+				dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(ce.Code, ce.Text), time.Now().Add(time.Second))
+			}
+			return
+		}
+		if err := dst.WriteMessage(mt, message); err != nil {
+			src.Close()
+			return
+		}
+	}
+}
+
+// pendingRequest is a request sent to a listener and waiting for its response.
+type pendingRequest struct {
+	// frame and body are the request sent on the rendezvous websocket when it is too large for
+	// the control channel.
+	frame []byte
+	body  []byte
+
+	resp chan *response
+}
+
+// response is the response of a listener. done is closed once the body is copied.
+type response struct {
+	frame *relay.ResponseFrame
+	body  io.Reader
+	done  chan struct{}
+}
+
+// respond hands a response over to the request waiting for it.
+func (s *Server) respond(f *relay.ResponseFrame, body io.Reader, done chan struct{}) bool {
+	s.mu.Lock()
+	p, ok := s.requests[f.RequestID]
+	delete(s.requests, f.RequestID)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	p.resp <- &response{frame: f, body: body, done: done}
+	return true
+}
+
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request) {
+	path, ok := s.route(r.URL.Path)
+	if !ok {
+		relayError(w, r, noListener, http.StatusNotFound)
+		return
+	}
+	if s.ClientAuthRequired {
+		if _, err := s.authorize(r, path); err != nil {
+			relayError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ch := s.pickListener(path)
+	if ch == nil {
+		relayError(w, r, noListener, http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		relayError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := uuid.New().String()
+	f := &relay.RequestFrame{
+		ID:             id,
+		Address:        ch.address(relay.ActionRequest, id),
+		Method:         r.Method,
+		RequestTarget:  requestTarget(r.URL),
+		RequestHeaders: connectHeaders(r),
+		RemoteEndpoint: remoteEndpoint(r),
+		Body:           len(body) > 0,
+	}
+
+	p := &pendingRequest{resp: make(chan *response, 1)}
+	s.mu.Lock()
+	s.requests[id] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.requests, id)
+		s.mu.Unlock()
+	}()
+
+	if len(body) > maxControlMessageSize {
+		// only the rendezvous address goes on the control channel
+		if p.frame, err = relay.EncodeFrame(f); err == nil {
+			p.body = body
+			err = ch.send(&relay.RequestFrame{ID: id, Address: f.Address}, nil)
+		}
+	} else {
+		err = ch.send(f, body)
+	}
+	if err != nil {
+		relayError(w, r, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var resp *response
+	select {
+	case resp = <-p.resp:
+	case <-time.After(s.timeout()):
+		relayError(w, r, "listener did not respond", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if resp.done != nil {
+		defer close(resp.done)
+	}
+
+	for name, values := range resp.frame.ResponseHeaders {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.frame.StatusCode)
+	io.Copy(w, resp.body)
+}
+
+// serveRendezvous serves the rendezvous websocket of a request: it sends the request if it was
+// too large for the control channel and receives the response.
+func (s *Server) serveRendezvous(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	p, ok := s.requests[id]
+	s.mu.Unlock()
+	if !ok {
+		relayError(w, r, "no pending request "+id, http.StatusNotFound)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	if p.frame != nil {
+		if err := ws.WriteMessage(websocket.TextMessage, p.frame); err != nil {
+			return
+		}
+		if len(p.body) > 0 {
+			if err := ws.WriteMessage(websocket.BinaryMessage, p.body); err != nil {
+				return
+			}
+		}
+	}
+
+	mt, message, err := ws.ReadMessage()
+	if err != nil || mt != websocket.TextMessage {
+		return
+	}
+	frame, err := relay.DecodeFrame(message)
+	if err != nil {
+		return
+	}
+	f, ok := frame.(*relay.ResponseFrame)
+	if !ok {
+		return
+	}
+
+	var body io.Reader = http.NoBody
+	if f.Body {
+		if _, body, err = ws.NextReader(); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	if s.respond(f, body, done) {
+		<-done
+	}
+}
+
+// connectHeaders returns the headers of a sender request passed to the listener.
+func connectHeaders(r *http.Request) relay.FrameHeader {
+	h := r.Header.Clone()
+	h.Del("ServiceBusAuthorization")
+	h.Set("Host", r.Host)
+	return relay.FrameHeader(h)
+}
+
+// requestTarget returns the request target passed to the listener, without the sb-hc-*
+// query parameters meant for the relay.
+func requestTarget(u *url.URL) string {
+	if !strings.Contains(u.RawQuery, "sb-hc-") {
+		return u.RequestURI()
+	}
+
+	q := u.Query()
+	for name := range q {
+		if strings.HasPrefix(name, "sb-hc-") {
+			q.Del(name)
+		}
+	}
+	target := url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: q.Encode()}
+	return target.RequestURI()
+}
+
+func remoteEndpoint(r *http.Request) relay.RemoteEndpoint {
+	host, port, _ := net.SplitHostPort(r.RemoteAddr)
+	p, _ := strconv.Atoi(port)
+	return relay.RemoteEndpoint{Address: host, Port: int32(p)}
+}
@@ -0,0 +1,96 @@
+package emulator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authorize validates the token of a request for the hybrid connection path and returns its
+// expiry. The token is sent in the ServiceBusAuthorization header or the sb-hc-token query
+// parameter.
+func (s *Server) authorize(r *http.Request, path string) (time.Time, error) {
+	token := r.Header.Get("ServiceBusAuthorization")
+	if token == "" {
+		token = r.URL.Query().Get("sb-hc-token")
+	}
+	return s.validateToken(token, r.Host, path)
+}
+
+// validateToken checks that a SAS token is signed with one of the keys of the server, has not
+// expired and covers the hybrid connection path. It returns the expiry of the token, or the zero
+// time if the server does not validate tokens.
+func (s *Server) validateToken(token, host, path string) (time.Time, error) {
+	if len(s.Keys) == 0 {
+		return time.Time{}, nil
+	}
+	if token == "" {
+		return time.Time{}, errors.New("missing token")
+	}
+
+	sas, ok := strings.CutPrefix(token, "SharedAccessSignature ")
+	if !ok {
+		return time.Time{}, errors.New("not a shared access signature")
+	}
+	values, err := url.ParseQuery(sas)
+	if err != nil {
+		return time.Time{}, errors.New("malformed shared access signature")
+	}
+	sr, sig, se, skn := values.Get("sr"), values.Get("sig"), values.Get("se"), values.Get("skn")
+
+	key, ok := s.Keys[skn]
+	if !ok {
+		return time.Time{}, errors.New("unknown key " + skn)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(url.QueryEscape(sr) + "\n" + se))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return time.Time{}, errors.New("invalid signature")
+	}
+
+	expiry, err := strconv.ParseInt(se, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("malformed expiry")
+	}
+	if !time.Now().Before(time.Unix(expiry, 0)) {
+		return time.Time{}, errors.New("token expired")
+	}
+
+	if !covers(sr, host, path) {
+		return time.Time{}, errors.New("token is not valid for " + path)
+	}
+	return time.Unix(expiry, 0), nil
+}
+
+// covers reports whether a token issued for the resource sr is valid for the hybrid connection
+// path on host: sr names the namespace or an entity path the hybrid connection lives under.
+// Ports are ignored.
+func covers(sr, host, path string) bool {
+	u, err := url.Parse(sr)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(hostname(u.Host), hostname(host)) {
+		return false
+	}
+
+	resource := strings.ToLower(strings.Trim(u.Path, "/"))
+	path = strings.ToLower(path)
+	return resource == "" || path == resource || strings.HasPrefix(path, resource+"/")
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
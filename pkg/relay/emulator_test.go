@@ -0,0 +1,453 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+	"github.com/BellaLi/azure-relay-GO/pkg/relay/emulator"
+	"github.com/gorilla/websocket"
+)
+
+var keys = map[string]string{"rule": "key"}
+
+func startEmulator(t *testing.T, s *emulator.Server) *emulator.Server {
+	t.Helper()
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func openListener(t *testing.T, s *emulator.Server, l *relay.Listener) *relay.Listener {
+	t.Helper()
+	l.NS, l.Path, l.Keyrule, l.Key, l.Dialer = "ns", "hc", "rule", "key", s.Dialer()
+	if err := l.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func newSender(s *emulator.Server) *relay.Sender {
+	return &relay.Sender{NS: "ns", Path: "hc", Keyrule: "rule", Key: "key", ClientAuthRequired: true,
+		Dialer: s.Dialer(), Transport: s.Transport()}
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Method", r.Method)
+	io.Copy(w, r.Body)
+}
+
+func TestEmulatorRequest(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys, ClientAuthRequired: true})
+	openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(echo)})
+	snd := newSender(s)
+
+	// bodies over 64KB go through rendezvous websockets, both ways
+	for _, size := range []int{0, 10, 64 << 10, 64<<10 + 1, 100 << 10, 3 << 20} {
+		body := strings.Repeat("a", size)
+
+		got, err := snd.SendRequest(http.MethodPost, body, "")
+		if err != nil {
+			t.Fatalf("SendRequest(%d bytes): %v", size, err)
+		}
+		if string(*got) != body {
+			t.Errorf("SendRequest(%d bytes) echoed %d bytes", size, len(*got))
+		}
+
+		resp, err := snd.Client().Post("https://ns/hc/echo", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post(%d bytes): %v", size, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(b) != body || resp.Header.Get("X-Method") != http.MethodPost {
+			t.Errorf("Post(%d bytes) = %s, %d bytes, %v", size, resp.Status, len(b), err)
+		}
+	}
+}
+
+func TestEmulatorConcurrentRequests(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(echo), ControlChannels: 2})
+	snd := newSender(s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.Repeat("b", i*16<<10)
+			got, err := snd.SendRequest(http.MethodPut, body, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(*got) != body {
+				t.Errorf("request %d echoed %d bytes, want %d", i, len(*got), len(body))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEmulatorMaxConcurrentRequests(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	openListener(t, s, &relay.Listener{
+		MaxConcurrentRequests: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		}),
+		AcceptHandler: func(ctx context.Context, a *relay.AcceptFrame, c *websocket.Conn) {
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+		},
+	})
+	snd := newSender(s)
+
+	go snd.SendRequest(http.MethodGet, "", "")
+	<-started
+
+	// the control channel keeps reading while the handlers are busy
+	for _, size := range []int{0, 100 << 10} {
+		var resp *relay.ResponseError
+		if _, err := snd.SendRequest(http.MethodPost, strings.Repeat("a", size), ""); !errors.As(err, &resp) || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("SendRequest(%d bytes) = %v, want 503 while the handler is busy", size, err)
+		}
+	}
+	c, err := snd.ConnectRelayWS(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("read %q, %v, want hello while the handler is busy", msg, err)
+	}
+}
+
+func TestEmulatorListenerQuota(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys, MaxListeners: 2})
+	l := openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(echo), ControlChannels: 3, MinReconnectDelay: 10 * time.Millisecond})
+
+	// the channel past the quota stops alone once it is refused again
+	time.Sleep(200 * time.Millisecond)
+	if st := l.Status(); st.State != relay.StateOnline || !errors.Is(st.Err, relay.ErrQuotaExceeded) {
+		t.Errorf("status = %v, %v, want online after a quota error", st.State, st.Err)
+	}
+	if n := s.NumListeners("hc"); n != 2 {
+		t.Errorf("%d listeners connected, want 2", n)
+	}
+	if _, err := newSender(s).SendRequest(http.MethodGet, "", ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmulatorDial(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys, ClientAuthRequired: true})
+	l := openListener(t, s, &relay.Listener{})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	c, err := newSender(s).DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, size := range []int{1, 1 << 10, 200 << 10} {
+		msg := bytes.Repeat([]byte{'c'}, size)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, size)
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("echoed %q, want %d bytes", got, size)
+		}
+	}
+}
+
+func TestEmulatorAcceptBacklog(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	l := openListener(t, s, &relay.Listener{})
+	snd := newSender(s)
+
+	// connections wait for Accept in the backlog, and the ones past it are rejected
+	var conns []io.Closer
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	var err error
+	for len(conns) <= 64 {
+		var c io.Closer
+		if c, err = snd.DialContext(context.Background()); err != nil {
+			break
+		}
+		conns = append(conns, c)
+	}
+	var re *relay.RelayError
+	if len(conns) != 64 || !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection %d: %v, want 503 past a backlog of 64", len(conns)+1, err)
+	}
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c, err := snd.DialContext(context.Background()); err != nil {
+		t.Errorf("connection after Accept: %v", err)
+	} else {
+		conns = append(conns, c)
+	}
+}
+
+func TestEmulatorAcceptHandler(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	openListener(t, s, &relay.Listener{AcceptHandler: func(ctx context.Context, a *relay.AcceptFrame, c *websocket.Conn) {
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(mt, msg)
+		}
+	}})
+
+	c, err := newSender(s).ConnectRelayWS(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("echoed %q, %v, want hello", msg, err)
+	}
+}
+
+func TestEmulatorShutdown(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	started, release := make(chan struct{}), make(chan struct{})
+	l := openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hc/slow" {
+			close(started)
+			<-release
+		}
+		echo(w, r)
+	})})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	snd := newSender(s)
+
+	ws, err := snd.ConnectRelayWS(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("echoed %q, %v, want hello", msg, err)
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := snd.Client().Get("https://ns/hc/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		slow <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- l.Shutdown(context.Background()) }()
+
+	// requests sent once the shutdown started are rejected, whatever their size
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := snd.Client().Get("https://ns/hc/fast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request during the shutdown = %s, want 503", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var resp *relay.ResponseError
+	if _, err := snd.SendRequest(http.MethodPost, strings.Repeat("a", 100<<10), ""); !errors.As(err, &resp) || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("large request during the shutdown = %v, want 503", err)
+	}
+	var re *relay.RelayError
+	if _, err := snd.DialContext(context.Background()); !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection during the shutdown = %v, want 503", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown = %v before the request in flight completed", err)
+	default:
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("request in flight = %v, want 200 OK", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("accepted connection closed with %v, want going away", err)
+	}
+}
+
+func TestEmulatorTokenRenewal(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+
+	var mu sync.Mutex
+	var states []relay.State
+	openListener(t, s, &relay.Listener{
+		Handler:  http.HandlerFunc(echo),
+		TokenTTL: 3 * time.Second,
+		OnStateChange: func(st relay.Status) {
+			mu.Lock()
+			states = append(states, st.State)
+			mu.Unlock()
+		},
+	})
+
+	// the emulator drops control channels whose token expires, here twice over unless renewed
+	time.Sleep(6 * time.Second)
+	if n := s.NumListeners("hc"); n != 1 {
+		t.Fatalf("%d listeners connected, want 1", n)
+	}
+	if _, err := newSender(s).SendRequest(http.MethodGet, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) != 2 || states[0] != relay.StateConnecting || states[1] != relay.StateOnline {
+		t.Errorf("states = %v, want [connecting online]", states)
+	}
+}
+
+func TestEmulatorUnauthorized(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys, ClientAuthRequired: true})
+
+	l := &relay.Listener{NS: "ns", Path: "hc", Keyrule: "rule", Key: "wrong", Dialer: s.Dialer()}
+	err := l.Open(context.Background())
+	var re *relay.RelayError
+	if !errors.Is(err, relay.ErrUnauthorized) || !errors.As(err, &re) || re.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Open = %v, want 401 unauthorized", err)
+	}
+
+	openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(echo)})
+	snd := newSender(s)
+	snd.Key = "wrong"
+	if _, err := snd.SendRequest(http.MethodGet, "", ""); !errors.Is(err, relay.ErrUnauthorized) {
+		t.Errorf("SendRequest = %v, want unauthorized", err)
+	}
+	if _, err := snd.DialContext(context.Background()); !errors.Is(err, relay.ErrUnauthorized) {
+		t.Errorf("DialContext = %v, want unauthorized", err)
+	}
+}
+
+func TestEmulatorSenderCredentials(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys, ClientAuthRequired: true})
+	openListener(t, s, &relay.Listener{Handler: http.HandlerFunc(echo), AcceptHandler: func(ctx context.Context, a *relay.AcceptFrame, c *websocket.Conn) {}})
+
+	// credentials are sent even if the sender does not ask for client authorization
+	snd := &relay.Sender{NS: "ns", Path: "hc", Keyrule: "rule", Key: "key", Dialer: s.Dialer(), Transport: s.Transport()}
+	if _, err := snd.SendRequest(http.MethodGet, "", ""); err != nil {
+		t.Errorf("SendRequest = %v", err)
+	}
+	if resp, err := snd.Client().Get("https://ns/hc"); err != nil {
+		t.Errorf("Get = %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Get = %s, want 200 OK", resp.Status)
+		}
+	}
+	if c, err := snd.ConnectRelayWS(context.Background(), ""); err != nil {
+		t.Errorf("ConnectRelayWS = %v", err)
+	} else {
+		c.Close()
+	}
+
+	// without credentials, requests go unauthorized unless the sender requires client authorization
+	snd = &relay.Sender{NS: "ns", Path: "hc", Dialer: s.Dialer(), Transport: s.Transport()}
+	if _, err := snd.SendRequest(http.MethodGet, "", ""); !errors.Is(err, relay.ErrUnauthorized) {
+		t.Errorf("SendRequest without credentials = %v, want unauthorized", err)
+	}
+	snd.ClientAuthRequired = true
+	if _, err := snd.SendRequest(http.MethodGet, "", ""); err == nil || errors.As(err, new(*relay.RelayError)) {
+		t.Errorf("SendRequest without credentials = %v, want an error before reaching the relay", err)
+	}
+}
+
+func TestEmulatorNoListener(t *testing.T) {
+	s := startEmulator(t, &emulator.Server{Keys: keys})
+	snd := newSender(s)
+
+	_, err := snd.SendRequest(http.MethodGet, "", "")
+	var re *relay.RelayError
+	if !errors.Is(err, relay.ErrNoListener) || errors.Is(err, relay.ErrNotFound) || !errors.As(err, &re) || re.StatusCode != http.StatusNotFound || re.TrackingID == "" {
+		t.Errorf("SendRequest = %v, want 404 no listener with a tracking id", err)
+	}
+	if _, err := snd.DialContext(context.Background()); !errors.Is(err, relay.ErrNoListener) {
+		t.Errorf("DialContext = %v, want no listener", err)
+	}
+
+	// a 404 of the listener itself is not an error of the relay
+	openListener(t, s, &relay.Listener{Handler: http.NotFoundHandler()})
+	_, err = snd.SendRequest(http.MethodGet, "", "")
+	var resp *relay.ResponseError
+	if !errors.As(err, &resp) || resp.StatusCode != http.StatusNotFound || errors.Is(err, relay.ErrNoListener) {
+		t.Errorf("SendRequest = %v, want the 404 response of the listener", err)
+	}
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// endpoint is where the relay namespace is reached.
+type endpoint struct {
+	secure bool
+
+	// host is the host and optional port of the relay.
+	host string
+}
+
+// newEndpoint returns the endpoint of namespace ns, or the one of override if not empty.
+// override is a URL such as https://localhost:8443, or a bare host and port reached over TLS.
+func newEndpoint(ns, override string) endpoint {
+	if override == "" {
+		return endpoint{secure: true, host: ns}
+	}
+	if !strings.Contains(override, "://") {
+		return endpoint{secure: true, host: strings.TrimRight(override, "/")}
+	}
+
+	u, err := url.Parse(override)
+	if err != nil || u.Host == "" {
+		return endpoint{secure: true, host: override}
+	}
+	return endpoint{secure: u.Scheme != "http" && u.Scheme != "ws", host: u.Host}
+}
+
+// wsURL returns the websocket URL of the relay for path. Secure websockets name port 443
+// unless another port is set.
+func (e endpoint) wsURL(path, query string) *url.URL {
+	u := &url.URL{Scheme: "ws", Host: e.host, Path: path, RawQuery: query}
+	if e.secure {
+		u.Scheme = "wss"
+		if _, _, err := net.SplitHostPort(e.host); err != nil {
+			u.Host = e.host + ":443"
+		}
+	}
+	return u
+}
+
+// httpURL returns the HTTP URL of the relay for path.
+func (e endpoint) httpURL(path, query string) *url.URL {
+	u := &url.URL{Scheme: "http", Host: e.host, Path: path, RawQuery: query}
+	if e.secure {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// hostname returns the host of the endpoint without its port, as named in token audiences.
+func (e endpoint) hostname() string {
+	if h, _, err := net.SplitHostPort(e.host); err == nil {
+		return h
+	}
+	return e.host
+}
@@ -0,0 +1,208 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// relayScope is the OAuth2 scope of Azure Relay for the v2.0 token endpoint.
+	relayScope = "https://relay.azure.net/.default"
+
+	// relayResource is the OAuth2 resource of Azure Relay for managed identities.
+	relayResource = "https://relay.azure.net/"
+
+	defaultAuthorityHost = "https://login.microsoftonline.com"
+	defaultIMDSEndpoint  = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// tokenRefreshFraction is the part of the lifetime of a cached access token after which it is
+	// refreshed. It is below the renewFraction of listeners less its jitter, so that a renewal
+	// always gets a new token rather than the one it renews.
+	tokenRefreshFraction = 0.5
+)
+
+// ClientCredentialsTokenProvider gets access tokens for the relay from Microsoft Entra ID with
+// the client credentials of an application. The tokens are sent as Bearer tokens.
+type ClientCredentialsTokenProvider struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+
+	// AuthorityHost is the Entra ID endpoint. If empty, https://login.microsoftonline.com is used.
+	AuthorityHost string
+
+	// Scope is the scope requested. If empty, https://relay.azure.net/.default is used.
+	Scope string
+
+	// HTTPClient is used to reach the token endpoint. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	cache tokenCache
+}
+
+// GetToken returns the cached access token, or gets a new one once half its lifetime has passed.
+func (p *ClientCredentialsTokenProvider) GetToken(ctx context.Context, audience string) (*Token, error) {
+	return p.cache.get(func() (*Token, error) {
+		if p.TenantID == "" || p.ClientID == "" || p.ClientSecret == "" {
+			return nil, errors.New("relay: tenant id, client id and client secret are required")
+		}
+
+		authority := p.AuthorityHost
+		if authority == "" {
+			authority = defaultAuthorityHost
+		}
+		scope := p.Scope
+		if scope == "" {
+			scope = relayScope
+		}
+
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {p.ClientID},
+			"client_secret": {p.ClientSecret},
+			"scope":         {scope},
+		}
+		endpoint := strings.TrimRight(authority, "/") + "/" + url.PathEscape(p.TenantID) + "/oauth2/v2.0/token"
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return requestAccessToken(p.HTTPClient, req)
+	})
+}
+
+// ManagedIdentityTokenProvider gets access tokens for the relay from the managed identity
+// endpoint of an Azure host (IMDS). The tokens are sent as Bearer tokens.
+type ManagedIdentityTokenProvider struct {
+	// ClientID selects a user-assigned identity. If empty, the system-assigned identity is used.
+	ClientID string
+
+	// Endpoint is the managed identity endpoint. If empty, the IMDS endpoint
+	// http://169.254.169.254/metadata/identity/oauth2/token is used.
+	Endpoint string
+
+	// Resource is the resource requested. If empty, https://relay.azure.net/ is used.
+	Resource string
+
+	// HTTPClient is used to reach the endpoint. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	cache tokenCache
+}
+
+// GetToken returns the cached access token, or gets a new one once half its lifetime has passed.
+func (p *ManagedIdentityTokenProvider) GetToken(ctx context.Context, audience string) (*Token, error) {
+	return p.cache.get(func() (*Token, error) {
+		endpoint := p.Endpoint
+		if endpoint == "" {
+			endpoint = defaultIMDSEndpoint
+		}
+		resource := p.Resource
+		if resource == "" {
+			resource = relayResource
+		}
+
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		query.Set("api-version", "2018-02-01")
+		query.Set("resource", resource)
+		if p.ClientID != "" {
+			query.Set("client_id", p.ClientID)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+
+		return requestAccessToken(p.HTTPClient, req)
+	})
+}
+
+// accessTokenResponse is the response of the token endpoints. Managed identity endpoints send
+// the numbers as strings.
+type accessTokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	ExpiresOn        json.Number `json:"expires_on"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func requestAccessToken(client *http.Client, req *http.Request) (*Token, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var r accessTokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("relay: token endpoint %s: %s: %v", req.URL.Host, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || r.AccessToken == "" {
+		return nil, fmt.Errorf("relay: token endpoint %s: %s: %s %s", req.URL.Host, resp.Status, r.Error, r.ErrorDescription)
+	}
+
+	var expiry time.Time
+	if on, err := strconv.ParseInt(r.ExpiresOn.String(), 10, 64); err == nil {
+		expiry = time.Unix(on, 0)
+	} else if in, err := strconv.ParseInt(r.ExpiresIn.String(), 10, 64); err == nil {
+		expiry = time.Now().Add(time.Duration(in) * time.Second)
+	}
+
+	return &Token{Value: "Bearer " + r.AccessToken, Expiry: expiry}, nil
+}
+
+// tokenCache holds an access token for part of its lifetime.
+type tokenCache struct {
+	mu        sync.Mutex
+	token     *Token
+	refreshAt time.Time
+}
+
+func (c *tokenCache) get(fetch func() (*Token, error)) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != nil && time.Now().Before(c.refreshAt) {
+		return c.token, nil
+	}
+
+	t, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.token = t
+	c.refreshAt = time.Time{}
+	if !t.Expiry.IsZero() {
+		now := time.Now()
+		c.refreshAt = now.Add(time.Duration(float64(t.Expiry.Sub(now)) * tokenRefreshFraction))
+	}
+	return t, nil
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCredentialsTokenProvider(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if r.Method != http.MethodPost || r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			t.Errorf("request = %s %s, want POST /tenant/oauth2/v2.0/token", r.Method, r.URL.Path)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		for name, want := range map[string]string{
+			"grant_type":    "client_credentials",
+			"client_id":     "client",
+			"client_secret": "secret",
+			"scope":         relayScope,
+		} {
+			if got := r.PostForm.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		fmt.Fprintf(w, `{"token_type":"Bearer","expires_in":3600,"access_token":"token%d"}`, n)
+	}))
+	defer srv.Close()
+
+	p := &ClientCredentialsTokenProvider{TenantID: "tenant", ClientID: "client", ClientSecret: "secret", AuthorityHost: srv.URL + "/"}
+	token, err := p.GetToken(context.Background(), "http://ns/hc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Value != "Bearer token1" {
+		t.Errorf("token = %q, want %q", token.Value, "Bearer token1")
+	}
+	if d := time.Until(token.Expiry); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("token expires in %v, want 1h", d)
+	}
+
+	if token, err = p.GetToken(context.Background(), "http://ns/hc"); err != nil {
+		t.Fatal(err)
+	}
+	if token.Value != "Bearer token1" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("second token = %q after %d requests, want the cached token after 1", token.Value, calls)
+	}
+}
+
+func TestManagedIdentityTokenProvider(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			t.Error("Metadata header is missing")
+		}
+		q := r.URL.Query()
+		if q.Get("resource") != relayResource || q.Get("client_id") != "identity" || q.Get("api-version") == "" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		fmt.Fprintf(w, `{"access_token":"token","expires_in":"3599","expires_on":"%d","resource":"%s","token_type":"Bearer"}`, expiresOn, relayResource)
+	}))
+	defer srv.Close()
+
+	p := &ManagedIdentityTokenProvider{ClientID: "identity", Endpoint: srv.URL + "/metadata/identity/oauth2/token"}
+	token, err := p.GetToken(context.Background(), "http://ns/hc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Value != "Bearer token" {
+		t.Errorf("token = %q, want %q", token.Value, "Bearer token")
+	}
+	if !token.Expiry.Equal(time.Unix(expiresOn, 0)) {
+		t.Errorf("expiry = %v, want %v", token.Expiry, time.Unix(expiresOn, 0))
+	}
+}
+
+func TestRequestAccessTokenExpiry(t *testing.T) {
+	tests := []struct {
+		body string
+		want time.Duration
+	}{
+		{`{"access_token":"t","expires_in":600}`, 10 * time.Minute},
+		{`{"access_token":"t","expires_in":"600"}`, 10 * time.Minute},
+		{fmt.Sprintf(`{"access_token":"t","expires_in":"60","expires_on":"%d"}`, time.Now().Add(time.Hour).Unix()), time.Hour},
+		{`{"access_token":"t"}`, 0},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.body))
+		}))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		token, err := requestAccessToken(nil, req)
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.body, err)
+			continue
+		}
+
+		if tt.want == 0 {
+			if !token.Expiry.IsZero() {
+				t.Errorf("%s: expiry = %v, want none", tt.body, token.Expiry)
+			}
+			continue
+		}
+		if d := time.Until(token.Expiry); d < tt.want-time.Minute || d > tt.want {
+			t.Errorf("%s: token expires in %v, want %v", tt.body, d, tt.want)
+		}
+	}
+}
+
+func TestRequestAccessTokenError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusUnauthorized, `{"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided."}`, "invalid_client AADSTS7000215"},
+		{http.StatusBadRequest, `{"error":"invalid_request","error_description":"Identity not found"}`, "400 Bad Request"},
+		{http.StatusOK, `{"token_type":"Bearer"}`, "200 OK"},
+		{http.StatusBadGateway, `<html>bad gateway</html>`, "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		_, err := requestAccessToken(nil, req)
+		srv.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d %s: error = %v, want it to contain %q", tt.status, tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	var c tokenCache
+	fetches := 0
+	fetch := func(lifetime time.Duration) func() (*Token, error) {
+		return func() (*Token, error) {
+			fetches++
+			token := &Token{Value: fmt.Sprint("token", fetches)}
+			if lifetime > 0 {
+				token.Expiry = time.Now().Add(lifetime)
+			}
+			return token, nil
+		}
+	}
+
+	token, _ := c.get(fetch(time.Hour))
+	if again, _ := c.get(fetch(time.Hour)); again != token {
+		t.Fatalf("got %q, want the cached %q", again.Value, token.Value)
+	}
+
+	// listeners renew a token no earlier than renewFraction less the jitter of its lifetime,
+	// and must then be handed a new one
+	earliestRenewal := time.Duration(float64(time.Hour) * renewFraction * (1 - renewJitter))
+	if d := time.Until(c.refreshAt); d >= earliestRenewal {
+		t.Errorf("token is refreshed in %v, after listeners renew it in %v", d, earliestRenewal)
+	}
+
+	c = tokenCache{}
+	token, _ = c.get(fetch(300 * time.Millisecond))
+	time.Sleep(200 * time.Millisecond)
+	if renewed, _ := c.get(fetch(300 * time.Millisecond)); renewed == token {
+		t.Errorf("got the cached %q past half its lifetime, want a new token", token.Value)
+	}
+
+	c = tokenCache{}
+	fetches = 0
+	c.get(fetch(0))
+	c.get(fetch(0))
+	if fetches != 2 {
+		t.Errorf("%d fetches, want tokens without expiry fetched every time", fetches)
+	}
+}
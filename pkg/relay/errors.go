@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// The classes of the errors returned by the relay. Use errors.Is to test a *RelayError against
+// them.
+var (
+	// ErrUnauthorized means the token was missing, invalid, expired or lacked the rights needed.
+	ErrUnauthorized = &relayErrorClass{"unauthorized"}
+
+	// ErrNotFound means the namespace or the hybrid connection does not exist.
+	ErrNotFound = &relayErrorClass{"hybrid connection not found"}
+
+	// ErrNoListener means the hybrid connection exists but no listener is connected to it. The
+	// relay then answers 404 with "There are no listeners connected for the endpoint".
+	ErrNoListener = &relayErrorClass{"no listener"}
+
+	// ErrQuotaExceeded means a quota of the namespace, such as the number of connections, is exhausted.
+	ErrQuotaExceeded = &relayErrorClass{"quota exceeded"}
+
+	// ErrTemporary means the relay could not be reached for a reason that may go away, such as a
+	// refused connection or a timeout, or failed in a way worth retrying.
+	ErrTemporary = &relayErrorClass{"temporary failure"}
+)
+
+type relayErrorClass struct{ name string }
+
+func (c *relayErrorClass) Error() string { return "relay: " + c.name }
+
+// RelayError is an error answered by the relay, or a failure to reach it.
+type RelayError struct {
+	// StatusCode is the HTTP status of the relay response, or 0 if the relay was not reached.
+	StatusCode int
+
+	// Description is the description of the error given by the relay.
+	Description string
+
+	// TrackingID identifies the failed operation for Azure support, if the relay gave one.
+	TrackingID string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+var trackingIDPattern = regexp.MustCompile(`TrackingId:\s*([^,\s]+)`)
+
+// noListenerDescription is in the description of the relay when no listener is connected.
+const noListenerDescription = "no listeners connected"
+
+// newRelayError returns the error of a failed relay response resp, wrapping err. resp may be nil
+// when the relay could not be reached.
+func newRelayError(resp *http.Response, err error) *RelayError {
+	var body []byte
+	if resp != nil && resp.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+	}
+	return relayError(resp, body, err)
+}
+
+// relayError returns the error of a failed relay response resp with the given body.
+func relayError(resp *http.Response, body []byte, err error) *RelayError {
+	e := &RelayError{Err: err}
+	if resp == nil {
+		return e
+	}
+
+	e.StatusCode = resp.StatusCode
+	e.Description = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	if e.Description == "" || e.Description == http.StatusText(resp.StatusCode) {
+		// the relay may only describe the error in the body
+		if b := strings.TrimSpace(string(body)); b != "" {
+			if len(b) > 1024 {
+				b = b[:1024]
+			}
+			e.Description = b
+		}
+	}
+
+	e.TrackingID = resp.Header.Get("TrackingId")
+	if m := trackingIDPattern.FindStringSubmatch(e.Description); e.TrackingID == "" && m != nil {
+		e.TrackingID = m[1]
+	}
+	return e
+}
+
+// responseError returns the error of a response other than 2xx to a request sent to the hybrid
+// connection: a *RelayError if the relay answered it, as told by its tracking id, or else a
+// *ResponseError of the listener.
+func responseError(resp *http.Response, body []byte) error {
+	if e := relayError(resp, body, nil); e.TrackingID != "" {
+		return e
+	}
+	return &ResponseError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+}
+
+func (e *RelayError) Error() string {
+	msg := "relay"
+	if e.StatusCode != 0 {
+		msg += ": " + strconv.Itoa(e.StatusCode)
+		if e.Description != "" {
+			msg += " " + e.Description
+		}
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RelayError) Unwrap() error { return e.Err }
+
+// Is reports whether the error belongs to one of the ErrUnauthorized, ErrNotFound, ErrNoListener,
+// ErrQuotaExceeded or ErrTemporary classes.
+func (e *RelayError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden && !e.mentions("quota")
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound && !e.mentions(noListenerDescription)
+	case ErrNoListener:
+		return e.StatusCode == http.StatusNotFound && e.mentions(noListenerDescription)
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusForbidden && e.mentions("quota")
+	case ErrTemporary:
+		return e.Temporary()
+	}
+	return false
+}
+
+// Temporary reports whether retrying may succeed: the relay could not be reached for a reason
+// that may go away, timed out, throttled the request or failed on its side.
+func (e *RelayError) Temporary() bool {
+	switch {
+	case e.StatusCode == 0:
+		return isTransient(e.Err)
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// isTransient reports whether err is a network failure that may go away, such as a refused
+// connection, a reset or a timeout. A name that does not resolve, a certificate that does not
+// verify, a malformed URL or a cancelled request are not.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &dnsErr):
+		return !dnsErr.IsNotFound
+	case errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) || errors.As(err, &invalidErr):
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (e *RelayError) mentions(word string) bool {
+	return strings.Contains(strings.ToLower(e.Description), word)
+}
+
+// closeError returns the error of a control channel the relay closed: a *RelayError classified
+// as the status the relay would have answered, for the close codes telling why, wrapping err.
+// Other errors are returned as is.
+func closeError(err error) error {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return err
+	}
+
+	status := 0
+	switch ce.Code {
+	case websocket.ClosePolicyViolation:
+		// the token expired or a renewed token was refused
+		status = http.StatusUnauthorized
+	case websocket.CloseInternalServerErr, websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+		status = http.StatusServiceUnavailable
+	default:
+		return err
+	}
+	return &RelayError{StatusCode: status, Description: ce.Text, Err: err}
+}
+
+// ResponseError is a response other than 2xx the listener of the hybrid connection answered to a
+// request sent with SendRequest.
+type ResponseError struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+
+	// Status is the status line of the response, such as "404 Not Found".
+	Status string
+
+	// Body is the body of the response.
+	Body []byte
+}
+
+func (e *ResponseError) Error() string {
+	return "relay: listener responded " + e.Status
+}
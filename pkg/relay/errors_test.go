@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestRelayErrorClasses(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		err  *RelayError
+		want []error
+	}{
+		{&RelayError{StatusCode: http.StatusUnauthorized, Description: "invalid signature"}, []error{ErrUnauthorized}},
+		{&RelayError{StatusCode: http.StatusForbidden, Description: "'Listen' claim(s) are required"}, []error{ErrUnauthorized}},
+		{&RelayError{StatusCode: http.StatusForbidden, Description: "Quota exceeded: listeners"}, []error{ErrQuotaExceeded}},
+		{&RelayError{StatusCode: http.StatusTooManyRequests}, []error{ErrQuotaExceeded, ErrTemporary}},
+		{&RelayError{StatusCode: http.StatusNotFound, Description: "There are no listeners connected for the endpoint. TrackingId:1"}, []error{ErrNoListener}},
+		{&RelayError{StatusCode: http.StatusNotFound, Description: "The messaging entity 'sb://ns/hc' could not be found."}, []error{ErrNotFound}},
+		{&RelayError{StatusCode: http.StatusServiceUnavailable}, []error{ErrTemporary}},
+		{&RelayError{Err: refused}, []error{ErrTemporary}},
+		{&RelayError{Err: &net.DNSError{Err: "i/o timeout", Name: "ns", IsTimeout: true}}, []error{ErrTemporary}},
+		{&RelayError{Err: io.ErrUnexpectedEOF}, []error{ErrTemporary}},
+		{&RelayError{Err: &net.DNSError{Err: "no such host", Name: "nosuchns.invalid", IsNotFound: true}}, nil},
+		{&RelayError{Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, nil},
+		{&RelayError{Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "ns"}}, nil},
+		{&RelayError{Err: &net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}}, nil},
+		{&RelayError{Err: errors.New("malformed ws or wss URL")}, nil},
+	}
+
+	classes := []error{ErrUnauthorized, ErrNotFound, ErrNoListener, ErrQuotaExceeded, ErrTemporary}
+	for _, tt := range tests {
+		for _, class := range classes {
+			want := false
+			for _, c := range tt.want {
+				want = want || c == class
+			}
+			if got := errors.Is(tt.err, class); got != want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, class, got, want)
+			}
+		}
+	}
+}
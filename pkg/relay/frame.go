@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnknownFrame is returned by DecodeFrame for a control frame of an unknown type.
+	ErrUnknownFrame = errors.New("relay: unknown frame")
+
+	// ErrMalformedFrame is returned by EncodeFrame and DecodeFrame for a control frame
+	// that is not valid JSON or misses required fields.
+	ErrMalformedFrame = errors.New("relay: malformed frame")
+)
+
+// Frame is a control message exchanged with the relay on a control channel or a rendezvous
+// websocket. It is one of *AcceptFrame, *RequestFrame, *ResponseFrame or *RenewTokenFrame.
+type Frame interface {
+	// frameName is the name of the single member of the JSON object carrying the frame.
+	frameName() string
+
+	// validate reports the required fields the frame is missing.
+	validate() error
+}
+
+// frameTypes creates an empty frame for every frame name known to DecodeFrame.
+var frameTypes = map[string]func() Frame{
+	"accept":     func() Frame { return new(AcceptFrame) },
+	"request":    func() Frame { return new(RequestFrame) },
+	"response":   func() Frame { return new(ResponseFrame) },
+	"renewToken": func() Frame { return new(RenewTokenFrame) },
+}
+
+// EncodeFrame returns the JSON encoding of a control frame, {"<name>":{...}}.
+func EncodeFrame(f Frame) ([]byte, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(map[string]Frame{f.frameName(): f})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformedFrame, f.frameName(), err)
+	}
+	return b, nil
+}
+
+// DecodeFrame decodes a control frame. The message must be a JSON object with a single member
+// naming the frame type. Unknown members inside a frame are ignored so that fields added to the
+// protocol do not break the listener.
+func DecodeFrame(b []byte) (Frame, error) {
+	var envelope map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data after frame", ErrMalformedFrame)
+	}
+	if len(envelope) != 1 {
+		names := make([]string, 0, len(envelope))
+		for name := range envelope {
+			names = append(names, name)
+		}
+		return nil, fmt.Errorf("%w: expected exactly one frame, got [%s]", ErrMalformedFrame, strings.Join(names, ", "))
+	}
+
+	var name string
+	var raw json.RawMessage
+	for name, raw = range envelope {
+	}
+
+	newFrame, ok := frameTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFrame, name)
+	}
+
+	f := newFrame()
+	if err := json.Unmarshal(raw, f); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformedFrame, name, err)
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// missing returns the error for a frame missing one of its required fields.
+func missing(frame, field string) error {
+	return fmt.Errorf("%w: %s: missing %s", ErrMalformedFrame, frame, field)
+}
+
+// AcceptFrame is the control message sent by the relay when a sender opens a websocket
+// connection to the hybrid connection.
+//
+// ConnectHeaders are the headers of the websocket handshake sent by the sender:
+// {"Sec-WebSocket-Key":"NsoFiXBuR3i2nE8Tx0+maA==","Sec-WebSocket-Version":"13","Connection":"Upgrade","Upgrade":"websocket",
+// "Host":"gorelay.servicebus.windows.net:443","User-Agent":"Go-http-client\/1.1"}
+type AcceptFrame struct {
+	ID             string         `json:"id"`
+	Address        string         `json:"address"`
+	ConnectHeaders FrameHeader    `json:"connectHeaders,omitempty"`
+	RemoteEndpoint RemoteEndpoint `json:"remoteEndpoint"`
+}
+
+func (*AcceptFrame) frameName() string { return "accept" }
+
+func (f *AcceptFrame) validate() error {
+	if f.ID == "" {
+		return missing("accept", "id")
+	}
+	if f.Address == "" {
+		return missing("accept", "address")
+	}
+	return nil
+}
+
+// RequestFrame is the control message sent by the relay when a sender issues an HTTP request
+// to the hybrid connection. Address is the rendezvous address of the request.
+type RequestFrame struct {
+	ID             string         `json:"id"`
+	Address        string         `json:"address,omitempty"`
+	Method         string         `json:"method,omitempty"`
+	RequestTarget  string         `json:"requestTarget,omitempty"`
+	RequestHeaders FrameHeader    `json:"requestHeaders,omitempty"`
+	RemoteEndpoint RemoteEndpoint `json:"remoteEndpoint"`
+	Body           bool           `json:"body"`
+}
+
+func (*RequestFrame) frameName() string { return "request" }
+
+func (f *RequestFrame) validate() error {
+	if f.ID == "" {
+		return missing("request", "id")
+	}
+	if f.Method == "" && f.Address == "" {
+		return missing("request", "method")
+	}
+	return nil
+}
+
+// ResponseFrame is the control message sent by the listener to answer a request frame.
+type ResponseFrame struct {
+	RequestID         string      `json:"requestId"`
+	StatusCode        int         `json:"statusCode,string"`
+	StatusDescription string      `json:"statusDescription,omitempty"`
+	ResponseHeaders   FrameHeader `json:"responseHeaders,omitempty"`
+	Body              bool        `json:"body"`
+}
+
+func (*ResponseFrame) frameName() string { return "response" }
+
+func (f *ResponseFrame) validate() error {
+	if f.RequestID == "" {
+		return missing("response", "requestId")
+	}
+	if f.StatusCode < 100 || f.StatusCode > 999 {
+		return fmt.Errorf("%w: response: invalid statusCode %d", ErrMalformedFrame, f.StatusCode)
+	}
+	return nil
+}
+
+// RenewTokenFrame is the control message sent by the listener to renew the token of its
+// control channel before the current one expires.
+type RenewTokenFrame struct {
+	Token string `json:"token"`
+}
+
+func (*RenewTokenFrame) frameName() string { return "renewToken" }
+
+func (f *RenewTokenFrame) validate() error {
+	if f.Token == "" {
+		return missing("renewToken", "token")
+	}
+	return nil
+}
+
+// RemoteEndpoint is the network address of the sender.
+type RemoteEndpoint struct {
+	Address string `json:"address"`
+	Port    int32  `json:"port"`
+}
+
+// FrameHeader is a set of headers carried by a control frame. The relay sends every header
+// as a string; a header sent as an array of strings keeps all of its values.
+type FrameHeader http.Header
+
+// MarshalJSON encodes the headers as a JSON object of strings, joining multiple values of
+// a header with commas.
+func (h FrameHeader) MarshalJSON() ([]byte, error) {
+	flat := make(map[string]string, len(h))
+	for k, v := range h {
+		flat[k] = strings.Join(v, ", ")
+	}
+	return json.Marshal(flat)
+}
+
+// UnmarshalJSON decodes a JSON object of headers, canonicalizing the header names.
+func (h *FrameHeader) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	header := make(FrameHeader, len(raw))
+	for k, v := range raw {
+		var values []string
+		if err := json.Unmarshal(v, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(v, &value); err != nil {
+				return errors.New("header " + k + " is neither a string nor an array of strings")
+			}
+			values = []string{value}
+		}
+		key := http.CanonicalHeaderKey(k)
+		header[key] = append(header[key], values...)
+	}
+
+	*h = header
+	return nil
+}
+
+// Get returns the first value of the header named key.
+func (h FrameHeader) Get(key string) string {
+	return http.Header(h).Get(key)
+}
+
+// Values returns all values of the header named key.
+func (h FrameHeader) Values(key string) []string {
+	return http.Header(h).Values(key)
+}
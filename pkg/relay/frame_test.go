@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Frame{
+		&AcceptFrame{
+			ID:             "ca496b91_G17",
+			Address:        "wss://ns/$hc/hc?sb-hc-action=accept&sb-hc-id=ca496b91_G17",
+			ConnectHeaders: FrameHeader{"Sec-Websocket-Key": {"NsoFiXBuR3i2nE8Tx0+maA=="}, "User-Agent": {"Go-http-client/1.1"}},
+			RemoteEndpoint: RemoteEndpoint{Address: "73.83.210.109", Port: 62917},
+		},
+		&RequestFrame{
+			ID:             "c126fddd_G12",
+			Method:         "POST",
+			RequestTarget:  "/hc/a?b=c",
+			RequestHeaders: FrameHeader{"Content-Type": {"application/json; charset=utf-8"}},
+			RemoteEndpoint: RemoteEndpoint{Address: "::1", Port: 443},
+			Body:           true,
+		},
+		&RequestFrame{ID: "c126fddd_G12", Address: "wss://ns/$hc/hc?sb-hc-action=request&sb-hc-id=c126fddd_G12"},
+		&ResponseFrame{RequestID: "c126fddd_G12", StatusCode: 200, StatusDescription: "OK", ResponseHeaders: FrameHeader{"X-Method": {"GET"}}, Body: true},
+		&ResponseFrame{RequestID: "c126fddd_G12", StatusCode: 503},
+		&RenewTokenFrame{Token: "SharedAccessSignature sr=http%3a%2f%2fns%2fhc&sig=a%2bb%3d&se=1&skn=rule"},
+		&RequestFrame{
+			ID:             "quote\"back\\slash",
+			Method:         "GET",
+			RequestTarget:  "/hc/\"</script> ",
+			RequestHeaders: FrameHeader{"X-Control": {"tab\tnewline\nnul\x00"}},
+		},
+	}
+	for _, f := range tests {
+		b, err := EncodeFrame(f)
+		if err != nil {
+			t.Errorf("EncodeFrame(%+v): %v", f, err)
+			continue
+		}
+		got, err := DecodeFrame(b)
+		if err != nil {
+			t.Errorf("DecodeFrame(%s): %v", b, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, f) {
+			t.Errorf("DecodeFrame(%s) = %+v, want %+v", b, got, f)
+		}
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Frame
+		err  error
+	}{
+		{`{"response":{"requestId":"1","statusCode":"200","body":false}}`, &ResponseFrame{RequestID: "1", StatusCode: 200}, nil},
+		{`{"response":{"requestId":"1","statusCode":200}}`, nil, ErrMalformedFrame},
+		{`{"response":{"requestId":"1","statusCode":"20"}}`, nil, ErrMalformedFrame},
+		{`{"request":{"id":"1","method":"GET","requestHeaders":{"accept":"text/plain","x-multi":["a","b"]},"extra":1}}`,
+			&RequestFrame{ID: "1", Method: "GET", RequestHeaders: FrameHeader{"Accept": {"text/plain"}, "X-Multi": {"a", "b"}}}, nil},
+		{`{"request":{"id":"1","method":"GET","requestHeaders":{"X-Bad":1}}}`, nil, ErrMalformedFrame},
+		{`{"accept":{"id":"1","address":"wss://ns/$hc/hc","connectHeaders":{"Host":"ns:443"}}}`,
+			&AcceptFrame{ID: "1", Address: "wss://ns/$hc/hc", ConnectHeaders: FrameHeader{"Host": {"ns:443"}}}, nil},
+		{`{"accept":{"address":"wss://ns/$hc/hc"}}`, nil, ErrMalformedFrame},
+		{`{"accept":{"id":"1"}}`, nil, ErrMalformedFrame},
+		{`{"request":{"method":"GET"}}`, nil, ErrMalformedFrame},
+		{`{"request":{"id":"1"}}`, nil, ErrMalformedFrame},
+		{`{"renewToken":{}}`, nil, ErrMalformedFrame},
+		{`{"unknown":{"id":"1"}}`, nil, ErrUnknownFrame},
+		{`{"accept":{"id":"1","address":"a"},"request":{"id":"2","method":"GET"}}`, nil, ErrMalformedFrame},
+		{`{"accept":{"id":"1","address":"a"}} {}`, nil, ErrMalformedFrame},
+		{`{"accept":{"id":"1","address":"a"}}}`, nil, ErrMalformedFrame},
+		{`{}`, nil, ErrMalformedFrame},
+		{`[]`, nil, ErrMalformedFrame},
+		{``, nil, ErrMalformedFrame},
+	}
+	for _, tt := range tests {
+		got, err := DecodeFrame([]byte(tt.in))
+		if !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("DecodeFrame(%s) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) && tt.want != nil {
+			t.Errorf("DecodeFrame(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeFrameMissingFields(t *testing.T) {
+	for _, f := range []Frame{
+		&AcceptFrame{Address: "a"},
+		&AcceptFrame{ID: "1"},
+		&RequestFrame{Method: "GET"},
+		&ResponseFrame{StatusCode: 200},
+		&ResponseFrame{RequestID: "1"},
+		&RenewTokenFrame{},
+	} {
+		if _, err := EncodeFrame(f); !errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("EncodeFrame(%+v) = %v, want %v", f, err, ErrMalformedFrame)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// respEvent is a message written by the single writer of a control channel. respBody, if any,
+// is written right after it as a binary message, so that a response frame is never separated
+// from its body.
+type respEvent struct {
+	MessageType int
+	respData    string
+	respBody    []byte
+}
+
+// AcceptHandler handles a websocket connection accepted by the listener.
+// The connection is closed when the handler returns.
+type AcceptHandler func(ctx context.Context, a *AcceptFrame, c *websocket.Conn)
+
+// Listener listens on an Azure Relay hybrid connection
+type Listener struct {
+	NS      string
+	Path    string
+	Keyrule string
+	Key     string
+
+	// Endpoint overrides where the relay is reached, as a URL such as https://localhost:8443 or
+	// ws://127.0.0.1:9000. Its scheme selects TLS (https, wss, sb) or plain connections (http, ws),
+	// and its host and port are used in every URI and in the token audience. If empty, the relay
+	// is reached at NS over TLS.
+	Endpoint string
+
+	// SharedAccessSignature is a pre-issued SAS token used instead of signing one with Key.
+	SharedAccessSignature string
+
+	// TokenProvider provides the tokens authorizing with the relay. If nil, the tokens are
+	// SharedAccessSignature or signed with Key.
+	TokenProvider TokenProvider
+
+	// TokenInQuery sends the token in the sb-hc-token query parameter of the control channels
+	// instead of the ServiceBusAuthorization header, for proxies that drop custom headers.
+	TokenInQuery bool
+
+	// TokenTTL is the lifetime of the tokens signed with Key. If zero, tokens are valid for an hour.
+	TokenTTL time.Duration
+
+	// Handler serves the HTTP requests sent to the hybrid connection.
+	// If nil, http.DefaultServeMux is used.
+	Handler http.Handler
+
+	// AcceptHandler is called for every websocket connection sent to the hybrid connection.
+	// If nil, websocket connections are returned by Accept.
+	AcceptHandler AcceptHandler
+
+	// OnTokenRenewalError is called when the token of a control channel failed to renew several
+	// times in a row, before the relay drops the control channel when the current token expires.
+	OnTokenRenewalError func(err *TokenRenewalError)
+
+	// ControlChannels is the number of control channels opened in parallel to the hybrid
+	// connection. They share the handlers and keep the listener online while one of them
+	// reconnects. A channel the relay refuses on its own account, such as one past the quota of
+	// listeners of the hybrid connection, stops while the others go on. If zero, a single
+	// control channel is opened.
+	ControlChannels int
+
+	// MaxConcurrentRequests is the number of HTTP requests served at the same time, across the
+	// control channels. Further requests are answered with 503 Service Unavailable until a
+	// handler returns. If zero, 64 is used.
+	MaxConcurrentRequests int
+
+	// OnStateChange is called when the listener goes online, offline, reconnects or closes.
+	// Calls are made one at a time, in order, from a separate goroutine.
+	OnStateChange func(s Status)
+
+	// MinReconnectDelay and MaxReconnectDelay bound the exponential backoff between attempts to
+	// reconnect a dropped control channel. If zero, 1 second and 2 minutes are used.
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// Dialer opens the control channels and the rendezvous websockets.
+	// If nil, websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+
+	// ErrorLog specifies an optional logger for errors that cannot be returned to the caller.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	initOnce sync.Once
+	workers  chan struct{}
+	acceptQ  chan *wsConn
+	backlog  chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	opened  bool
+	closing bool
+	err     error
+	conns   connRegistry
+
+	shuttingDown bool
+	handlers     sync.WaitGroup
+
+	channels  []State
+	status    Status
+	statusQ   []Status
+	notifying bool
+}
+
+const defaultMaxConcurrentRequests = 64
+
+// acceptBacklog is the number of connections dialed or queued for Accept before new connections
+// are rejected with 503 Service Unavailable.
+const acceptBacklog = 64
+
+// rendezvousTimeout is how long dialing the rendezvous websocket of a connection may take.
+const rendezvousTimeout = 30 * time.Second
+
+// GetRelayListenerURI is a function to get listener uri
+func (l *Listener) GetRelayListenerURI(correlationID string) string {
+	return RelayURI{NS: l.NS, Endpoint: l.Endpoint, Path: l.Path, Action: ActionListen, ID: correlationID}.String()
+}
+
+// CreateRelaySASToken is a function to get the listener token from its token provider.
+// It returns an empty string if the token provider fails.
+func (l *Listener) CreateRelaySASToken() string {
+	token, err := l.getToken(context.Background())
+	if err != nil {
+		return ""
+	}
+	return token.Value
+}
+
+// hasCredentials reports whether the listener has credentials to get tokens with.
+func (l *Listener) hasCredentials() bool {
+	return hasCredentials(l.TokenProvider, l.SharedAccessSignature, l.Keyrule, l.Key)
+}
+
+// getToken gets a token for the hybrid connection from the token provider.
+func (l *Listener) getToken(ctx context.Context) (*Token, error) {
+	return defaultTokenProvider(l.TokenProvider, l.SharedAccessSignature, l.Keyrule, l.Key, l.TokenTTL).GetToken(ctx, audience(newEndpoint(l.NS, l.Endpoint).hostname(), l.Path))
+}
+
+// Listen opens the listener and blocks until ctx is done, the listener is closed or the
+// relay refuses the control channel for good.
+func (l *Listener) Listen(ctx context.Context) error {
+	if err := l.Open(ctx); err != nil {
+		return err
+	}
+
+	<-l.done
+	return l.closeErr()
+}
+
+// Open connects the control channels to the relay. The listener then receives requests and
+// connections in the background until ctx is done or Close is called, reconnecting the control
+// channels with backoff whenever they drop. While no control channel connects and the relay fails
+// temporarily, as when it cannot be reached, Open dials them again with the same backoff. It
+// returns an error once the relay refuses them for good or ctx is done.
+func (l *Listener) Open(ctx context.Context) error {
+	l.lazyInit()
+
+	n := l.ControlChannels
+	if n < 1 {
+		n = 1
+	}
+
+	l.mu.Lock()
+	if l.closing {
+		l.mu.Unlock()
+		return net.ErrClosed
+	}
+	if l.opened {
+		l.mu.Unlock()
+		return errors.New("relay: listener already opened")
+	}
+	l.opened = true
+	l.channels = make([]State, n)
+	l.mu.Unlock()
+
+	channels, err := l.openControlChannels(ctx, n)
+	if err != nil {
+		l.mu.Lock()
+		l.opened = false
+		l.mu.Unlock()
+		return err
+	}
+
+	l.mu.Lock()
+	if l.closing {
+		l.mu.Unlock()
+		for _, ch := range channels {
+			if ch.conn != nil {
+				ch.conn.Close()
+			}
+		}
+		return net.ErrClosed
+	}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	ctx, cancel := l.ctx, l.cancel
+	l.mu.Unlock()
+
+	go func() {
+		var mu sync.Mutex
+		var err error
+		var wg sync.WaitGroup
+		for _, ch := range channels {
+			wg.Add(1)
+			go func(ch *controlChannel) {
+				defer wg.Done()
+				chErr := l.serveControlChannel(ctx, ch)
+				if ctx.Err() != nil {
+					return
+				}
+
+				// the relay refused the channel for good: the listener stops if the refusal holds
+				// for all channels, as a bad token does, or if no channel is left online
+				l.setChannelState(ch.index, StateClosed, chErr)
+				mu.Lock()
+				defer mu.Unlock()
+				if refusesAll(chErr) || l.Status().State != StateOnline {
+					if err == nil {
+						err = chErr
+					}
+					cancel()
+					return
+				}
+				l.logf("relay: control channel %d stopped: %v", ch.index, chErr)
+			}(ch)
+		}
+		wg.Wait()
+
+		if err == nil {
+			err = ctx.Err()
+		}
+		l.finish(err)
+	}()
+	return nil
+}
+
+// Accept waits for and returns the next websocket connection sent to the hybrid connection.
+// Accept implements net.Listener, so the listener can be passed to http.Serve and friends.
+//
+// Connections are accepted from the relay as they arrive and wait for Accept in a backlog of 64.
+// Further connections are rejected with 503 Service Unavailable until Accept takes them.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.lazyInit()
+
+	for {
+		select {
+		case c := <-l.acceptQ:
+			<-l.backlog
+			if l.isShuttingDown() {
+				// Shutdown closes it with the other connections
+				l.logf("relay: shutting down, dropping connection %s", c.frame.ID)
+				continue
+			}
+			return c, nil
+
+		case <-l.done:
+			return nil, l.closeErr()
+		}
+	}
+}
+
+// Close closes the control channel. Any blocked Accept operations will be unblocked and
+// return net.ErrClosed. Connections already accepted are not closed.
+func (l *Listener) Close() error {
+	l.lazyInit()
+
+	l.mu.Lock()
+	l.closing = true
+	cancel := l.cancel
+	l.mu.Unlock()
+
+	if cancel == nil {
+		l.finish(net.ErrClosed)
+		return nil
+	}
+
+	cancel()
+	<-l.done
+	return nil
+}
+
+// Addr returns the address of the hybrid connection.
+func (l *Listener) Addr() net.Addr {
+	return &Addr{NS: l.NS, Path: l.Path}
+}
+
+func (l *Listener) lazyInit() {
+	l.initOnce.Do(func() {
+		n := l.MaxConcurrentRequests
+		if n <= 0 {
+			n = defaultMaxConcurrentRequests
+		}
+		l.workers = make(chan struct{}, n)
+		l.acceptQ = make(chan *wsConn, acceptBacklog)
+		l.backlog = make(chan struct{}, acceptBacklog)
+		l.done = make(chan struct{})
+	})
+}
+
+// finish records the reason the control channel ended and releases the waiters.
+func (l *Listener) finish(err error) {
+	l.doneOnce.Do(func() {
+		l.mu.Lock()
+		if l.closing {
+			err = net.ErrClosed
+		}
+		l.err = err
+		l.mu.Unlock()
+
+		if err == net.ErrClosed {
+			err = nil
+		}
+		l.closeState(err)
+		close(l.done)
+
+		// close the connections queued for Accept, which no longer returns them
+		for {
+			select {
+			case c := <-l.acceptQ:
+				<-l.backlog
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+}
+
+func (l *Listener) closeErr() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *Listener) relayConnect(ctx context.Context) (con *websocket.Conn, hcID string, token *Token, err error) {
+	hcID = uuid.New().String()
+	u := l.GetRelayListenerURI(hcID)
+
+	// without credentials, as against an emulator without keys, the channel is not authorized
+	headers := make(http.Header)
+	if l.hasCredentials() {
+		if token, err = l.getToken(ctx); err != nil {
+			return
+		}
+
+		if l.TokenInQuery {
+			u = RelayURI{NS: l.NS, Endpoint: l.Endpoint, Path: l.Path, Action: ActionListen, ID: hcID, Token: token.Value}.String()
+		} else {
+			headers["ServiceBusAuthorization"] = []string{token.Value}
+		}
+	}
+
+	con, httpResp, err := l.dialer().DialContext(ctx, u, headers)
+	if err != nil {
+		return nil, hcID, token, newRelayError(httpResp, err)
+	}
+	return
+}
+
+func (l *Listener) acceptClient(ctx context.Context, a *AcceptFrame) {
+	c, err := l.dialRendezvous(ctx, a)
+	if err != nil {
+		l.logf("relay: [%s] unable to accept: %v", a.ID, err)
+		return
+	}
+	defer func() {
+		l.conns.remove(a.ID)
+		c.Close()
+	}()
+
+	l.AcceptHandler(ctx, a, c)
+}
+
+// queueConn dials the rendezvous websocket of a connection and queues it for Accept. The caller
+// holds a place in the backlog for it.
+func (l *Listener) queueConn(ctx context.Context, a *AcceptFrame) {
+	c, err := l.dialRendezvous(ctx, a)
+	if err != nil {
+		<-l.backlog
+		l.logf("relay: [%s] unable to accept: %v", a.ID, err)
+		return
+	}
+	conn := newWSConn(c, l.Addr(), a.RemoteEndpoint.addr(), func() { l.conns.remove(a.ID) })
+	conn.frame = a
+
+	select {
+	case <-l.done:
+		<-l.backlog
+		conn.Close()
+	default:
+		l.acceptQ <- conn
+	}
+}
+
+// rejectAccept rejects a connection with status, which the relay answers to the sender.
+func (l *Listener) rejectAccept(ctx context.Context, a *AcceptFrame, status int, description string) {
+	u, err := url.Parse(a.Address)
+	if err != nil {
+		l.logf("relay: [%s] unable to reject the connection: %v", a.ID, err)
+		return
+	}
+	q := u.Query()
+	q.Set("sb-hc-statusCode", strconv.Itoa(status))
+	q.Set("sb-hc-statusDescription", description)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, rendezvousTimeout)
+	defer cancel()
+	c, resp, err := l.dialer().DialContext(ctx, u.String(), nil)
+	if c != nil {
+		c.Close()
+	}
+	if resp == nil && err != nil {
+		l.logf("relay: [%s] unable to reject the connection: %v", a.ID, err)
+	}
+}
+
+// dialRendezvous completes the rendezvous handshake for an accept frame and tracks the accepted websocket.
+func (l *Listener) dialRendezvous(ctx context.Context, a *AcceptFrame) (*websocket.Conn, error) {
+	if l.conns.exists(a.ID) {
+		return nil, errors.New("connection " + a.ID + " already exists")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rendezvousTimeout)
+	defer cancel()
+	c, _, err := l.dialer().DialContext(ctx, a.Address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.conns.add(a, c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+/* listen on the control channel and send back the responses */
+func (l *Listener) recieveMessages(ctx context.Context, c *websocket.Conn, hcID string, token *Token) error {
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	/* setup response worker */
+	respQ := make(chan respEvent, 5)
+	send := func(resp respEvent) {
+		select {
+		case respQ <- resp:
+		case <-done:
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := c.WriteMessage(websocket.PingMessage, nil)
+				if err != nil {
+					l.logf("relay: failed to send ping message on %s: %v", hcID, err)
+					c.Close()
+					return
+				}
+
+			case resp := <-respQ:
+				err := writeEvent(c, resp)
+				if err != nil {
+					l.logf("relay: failed to write to %s: %v", hcID, err)
+					c.Close()
+					return
+				}
+
+			case <-ctx.Done():
+				// flush the queued responses, then close cleanly to unblock the reader
+				for len(respQ) > 0 {
+					resp := <-respQ
+					if err := writeEvent(c, resp); err != nil {
+						break
+					}
+				}
+				c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				c.Close()
+				return
+
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	/* setup renewing worker */
+	if token != nil {
+		go l.renewTokens(ctx, hcID, token, send, done)
+	}
+
+	for {
+		mt, message, err := c.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("relay: reading control channel %s: %w", hcID, closeError(err))
+		}
+
+		if mt != websocket.TextMessage {
+			return fmt.Errorf("relay: unexpected binary message on control channel %s", hcID)
+		}
+
+		frame, err := DecodeFrame(message)
+		if errors.Is(err, ErrUnknownFrame) {
+			l.logf("relay: ignoring frame on %s: %v", hcID, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("relay: decoding frame on control channel %s: %w", hcID, err)
+		}
+
+		switch f := frame.(type) {
+		case *AcceptFrame:
+			/* websocket sample
+			{"accept":{
+				"address":"wss:\/\/g17-prod-by3-010-sb.servicebus.windows.net\/$hc\/yesclientauth?sb-hc-action=accept&sb-hc-id=ca496b91-f5a3-4761-8eda-9a66dd9a2558_G17_G30",
+				"id":"ca496b91-f5a3-4761-8eda-9a66dd9a2558_G17_G30",
+				"connectHeaders":{"Sec-WebSocket-Key":"NsoFiXBuR3i2nE8Tx0+maA==","Sec-WebSocket-Version":"13","Connection":"Upgrade","Upgrade":"websocket","Host":"gorelay.servicebus.windows.net:443","User-Agent":"Go-http-client\/1.1"},
+				"remoteEndpoint":{"address":"73.83.210.109","port":62917}
+			}}
+			*/
+			if l.isShuttingDown() {
+				go l.rejectAccept(ctx, f, http.StatusServiceUnavailable, "listener is shutting down")
+				continue
+			}
+			if l.AcceptHandler != nil {
+				go l.acceptClient(ctx, f)
+				continue
+			}
+
+			select {
+			case l.backlog <- struct{}{}:
+				go l.queueConn(ctx, f)
+			default:
+				l.logf("relay: accept backlog is full, rejecting connection %s", f.ID)
+				go l.rejectAccept(ctx, f, http.StatusServiceUnavailable, "accept backlog is full")
+			}
+
+		case *RequestFrame:
+			/* http sample
+			{"request":{"address":"wss://g12-prod-by3-010-sb.servicebus.windows.net/$hc/yesclientauth?sb-hc-action=request&sb-hc-id=c126fddd-5ca6-430f-9b10-e2188d1ed0d4_G12",
+			"id":"c126fddd-5ca6-430f-9b10-e2188d1ed0d4_G12","requestTarget":"/yesclientauth","method":"POST","remoteEndpoint":{"address":"73.83.210.109","port":62915},
+			"requestHeaders":{"Content-Type":"application/json; charset=utf-8","Accept-Encoding":"gzip","Host":"gorelay.servicebus.windows.net","User-Agent":"Go-http-client/1.1","Via":"1.1 gorelay.servicebus.windows.net"},"body":true}}
+			*/
+			if f.Method == "" {
+				// the request is too large for the control channel
+				if !l.startHandler() || !l.runWorker(func() { l.serveRendezvous(ctx, f) }) {
+					go l.rejectRendezvous(ctx, f)
+				}
+				continue
+			}
+
+			var body []byte
+			if f.Body {
+				_, body, err = c.ReadMessage()
+				if err != nil {
+					return fmt.Errorf("relay: reading request body on control channel %s: %w", hcID, closeError(err))
+				}
+			}
+
+			if !l.startHandler() || !l.runWorker(func() { l.serveRequest(ctx, f, body, send) }) {
+				l.rejectRequest(f, send)
+			}
+
+		default:
+			return fmt.Errorf("relay: unexpected %T on control channel %s", frame, hcID)
+		}
+	}
+}
+
+// runWorker runs a request handler registered with startHandler in its own goroutine, or
+// reports false if MaxConcurrentRequests handlers already run. It never blocks, so that a busy
+// handler holds up neither the control channel nor the connections arriving on it.
+func (l *Listener) runWorker(serve func()) bool {
+	select {
+	case l.workers <- struct{}{}:
+	default:
+		l.handlers.Done()
+		return false
+	}
+
+	go func() {
+		defer func() {
+			<-l.workers
+			l.handlers.Done()
+		}()
+		serve()
+	}()
+	return true
+}
+
+// writeEvent writes a message and its body to a control channel.
+func writeEvent(c *websocket.Conn, resp respEvent) error {
+	if err := c.WriteMessage(resp.MessageType, []byte(resp.respData)); err != nil {
+		return err
+	}
+	if len(resp.respBody) == 0 {
+		return nil
+	}
+	return c.WriteMessage(websocket.BinaryMessage, resp.respBody)
+}
+
+func (l *Listener) dialer() *websocket.Dialer {
+	if l.Dialer != nil {
+		return l.Dialer
+	}
+	return websocket.DefaultDialer
+}
+
+func (l *Listener) logf(format string, args ...interface{}) {
+	if l.ErrorLog != nil {
+		l.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
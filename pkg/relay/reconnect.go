@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultMinReconnectDelay = time.Second
+	defaultMaxReconnectDelay = 2 * time.Minute
+)
+
+// controlChannel is one of the control channels of a listener.
+type controlChannel struct {
+	index int
+	conn  *websocket.Conn
+	hcID  string
+
+	// token is the token the channel was opened with, or nil without credentials.
+	token *Token
+
+	// err is the error of the last dial, if it failed.
+	err error
+}
+
+// dialControlChannel dials the control channel index and reports its state.
+func (l *Listener) dialControlChannel(ctx context.Context, index int) *controlChannel {
+	ch := &controlChannel{index: index}
+	l.setChannelState(index, StateConnecting, nil)
+	ch.conn, ch.hcID, ch.token, ch.err = l.relayConnect(ctx)
+	if ch.err != nil {
+		l.setChannelState(index, StateOffline, ch.err)
+		return ch
+	}
+	l.setChannelState(index, StateOnline, nil)
+	return ch
+}
+
+// openControlChannels dials the n control channels of the listener, again with backoff as long as
+// none connects and the relay fails temporarily. Names that do not resolve, certificates that do
+// not verify and malformed URLs are not temporary. If ctx ends first, the error wraps both its
+// error and the last dial error.
+func (l *Listener) openControlChannels(ctx context.Context, n int) ([]*controlChannel, error) {
+	for attempt := 0; ; attempt++ {
+		channels := make([]*controlChannel, n)
+		var wg sync.WaitGroup
+		for i := range channels {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				channels[i] = l.dialControlChannel(ctx, i)
+			}(i)
+		}
+		wg.Wait()
+
+		var err error
+		for _, ch := range channels {
+			if ch.err == nil {
+				return channels, nil
+			}
+			if err == nil || !isTemporary(ch.err) {
+				err = ch.err
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("relay: opening the control channels: %w, last error: %w", ctx.Err(), err)
+		}
+		if !isTemporary(err) {
+			return nil, err
+		}
+		l.logf("relay: unable to open the control channels (attempt %d): %v", attempt+1, err)
+
+		timer := time.NewTimer(l.reconnectDelay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("relay: opening the control channels: %w, last error: %w", ctx.Err(), err)
+		case <-l.done:
+			timer.Stop()
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// serveControlChannel serves a control channel and reconnects it whenever it drops, until ctx is
+// done or the relay refuses the listener for good.
+func (l *Listener) serveControlChannel(ctx context.Context, ch *controlChannel) error {
+	for {
+		if ch.err != nil {
+			if err := l.reconnect(ctx, ch); err != nil {
+				return err
+			}
+		}
+
+		err := l.recieveMessages(ctx, ch.conn, ch.hcID, ch.token)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.logf("relay: control channel %s dropped: %v", ch.hcID, err)
+		l.setChannelState(ch.index, StateOffline, err)
+		ch.err = err
+	}
+}
+
+// reconnect dials a control channel again with exponential backoff. It gives up when ctx is
+// done or the relay refuses a dial with a permanent error. A channel dropped for an expired token
+// is dialed again, with a new token.
+func (l *Listener) reconnect(ctx context.Context, ch *controlChannel) error {
+	for attempt := 0; ; attempt++ {
+		timer := time.NewTimer(l.reconnectDelay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		*ch = *l.dialControlChannel(ctx, ch.index)
+		if ch.err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isPermanent(ch.err) {
+			return ch.err
+		}
+		l.logf("relay: unable to reconnect the control channel (attempt %d): %v", attempt+1, ch.err)
+	}
+}
+
+// reconnectDelay returns the delay before the given reconnection attempt: the delay doubles with
+// every attempt up to MaxReconnectDelay, and a random half of it is taken off so that listeners
+// dropped together do not reconnect together.
+func (l *Listener) reconnectDelay(attempt int) time.Duration {
+	min, max := l.MinReconnectDelay, l.MaxReconnectDelay
+	if min <= 0 {
+		min = defaultMinReconnectDelay
+	}
+	if max <= 0 {
+		max = defaultMaxReconnectDelay
+	}
+
+	d := max
+	if attempt < 32 {
+		if backoff := min << uint(attempt); backoff > 0 && backoff < d {
+			d = backoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// refusesAll reports whether the relay refused a control channel for a reason holding for all the
+// channels of the listener, such as a bad token or a missing hybrid connection, unlike a quota of
+// listeners exceeded by one more channel.
+func refusesAll(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotFound)
+}
+
+// isTemporary reports whether the relay could not be reached or failed in a way worth retrying.
+// Other errors, such as a token provider failing, are not.
+func isTemporary(err error) bool {
+	var re *RelayError
+	return errors.As(err, &re) && re.Temporary()
+}
+
+// isPermanent reports whether the relay refused the control channel in a way retrying cannot
+// fix, such as a bad token or a missing hybrid connection. Failures to reach a relay reached
+// before are not, as a name that stopped resolving may resolve again.
+func isPermanent(err error) bool {
+	var re *RelayError
+	return errors.As(err, &re) && re.StatusCode != 0 && !re.Temporary()
+}
@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnInfo describes a websocket connection accepted by the listener.
+type ConnInfo struct {
+	ID             string
+	RemoteEndpoint RemoteEndpoint
+	ConnectHeaders FrameHeader
+
+	// Accepted is when the connection was accepted.
+	Accepted time.Time
+}
+
+// Conns returns the connections accepted by the listener and still open, oldest first.
+func (l *Listener) Conns() []ConnInfo {
+	return l.conns.list()
+}
+
+// LookupConn returns the accepted connection with the given id.
+func (l *Listener) LookupConn(id string) (ConnInfo, bool) {
+	rc, ok := l.conns.get(id)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return rc.info, true
+}
+
+// NumConns returns the number of accepted connections still open.
+func (l *Listener) NumConns() int {
+	return l.conns.len()
+}
+
+// CloseConn closes the accepted connection with the given id with a policy violation close
+// frame. The handler of the connection sees its next read fail.
+func (l *Listener) CloseConn(id string) error {
+	rc, ok := l.conns.get(id)
+	if !ok {
+		return errors.New("relay: no connection " + id)
+	}
+	l.conns.remove(id)
+	closeWS(rc.ws, websocket.ClosePolicyViolation)
+	return nil
+}
+
+// connRegistry tracks the accepted connections of a listener until they end.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*registeredConn
+}
+
+type registeredConn struct {
+	ws   *websocket.Conn
+	info ConnInfo
+}
+
+func (r *connRegistry) exists(id string) bool {
+	_, ok := r.get(id)
+	return ok
+}
+
+// add registers the websocket of an accept frame. It fails if the id is already registered.
+func (r *connRegistry) add(a *AcceptFrame, ws *websocket.Conn) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.conns[a.ID]; ok {
+		return errors.New("connection " + a.ID + " already exists")
+	}
+	if r.conns == nil {
+		r.conns = make(map[string]*registeredConn)
+	}
+	r.conns[a.ID] = &registeredConn{ws: ws, info: ConnInfo{
+		ID:             a.ID,
+		RemoteEndpoint: a.RemoteEndpoint,
+		ConnectHeaders: a.ConnectHeaders,
+		Accepted:       time.Now(),
+	}}
+	return nil
+}
+
+func (r *connRegistry) remove(id string) {
+	r.mu.Lock()
+	delete(r.conns, id)
+	r.mu.Unlock()
+}
+
+func (r *connRegistry) get(id string) (*registeredConn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rc, ok := r.conns[id]
+	return rc, ok
+}
+
+func (r *connRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+func (r *connRegistry) list() []ConnInfo {
+	r.mu.Lock()
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for _, rc := range r.conns {
+		infos = append(infos, rc.info)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Accepted.Before(infos[j].Accepted) })
+	return infos
+}
+
+// closeAll removes all the connections and closes them with the given close code.
+func (r *connRegistry) closeAll(code int) {
+	r.mu.Lock()
+	conns := r.conns
+	r.conns = nil
+	r.mu.Unlock()
+
+	for _, rc := range conns {
+		closeWS(rc.ws, code)
+	}
+}
+
+// closeWS sends a close frame with the given code and closes the websocket.
+func closeWS(c *websocket.Conn, code int) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+	c.Close()
+}
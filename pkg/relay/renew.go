@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// renewFraction is the part of the lifetime of a token after which it is renewed.
+	renewFraction = 0.75
+
+	// renewJitter is the largest part of the renewal delay randomly taken off it, so that
+	// control channels do not all renew at once.
+	renewJitter = 0.1
+
+	// renewRetryDelay is the delay before retrying a failed renewal. It doubles with every
+	// failure up to renewMaxRetryDelay.
+	renewRetryDelay    = 10 * time.Second
+	renewMaxRetryDelay = 5 * time.Minute
+
+	// renewFailureThreshold is the number of failed renewals in a row reported to OnTokenRenewalError.
+	renewFailureThreshold = 3
+)
+
+// errTokenNotRenewed is the renewal error of a token provider returning the token being renewed.
+var errTokenNotRenewed = errors.New("relay: token provider returned the token being renewed")
+
+// TokenRenewalError reports that the token of a control channel could not be renewed.
+type TokenRenewalError struct {
+	// ChannelID is the sb-hc-id of the control channel.
+	ChannelID string
+
+	// Failures is the number of failed renewals in a row.
+	Failures int
+
+	// Expiry is when the current token expires and the relay drops the control channel,
+	// or the zero time if unknown.
+	Expiry time.Time
+
+	Err error
+}
+
+func (e *TokenRenewalError) Error() string {
+	return fmt.Sprintf("relay: token renewal of %s failed %d times, token expires at %v: %v", e.ChannelID, e.Failures, e.Expiry, e.Err)
+}
+
+func (e *TokenRenewalError) Unwrap() error { return e.Err }
+
+// renewTokens sends renewToken frames on a control channel opened with current until done is
+// closed. The token is renewed after a fraction of its lifetime and failed renewals are retried
+// until it expires. A provider handing back the current token again, as a static token does,
+// fails the renewal rather than sending the same token over and over.
+func (l *Listener) renewTokens(ctx context.Context, hcID string, current *Token, send func(respEvent), done <-chan struct{}) {
+	failures := 0
+	expiry := current.Expiry
+	timer := time.NewTimer(renewDelay(expiry))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+
+		token, err := l.getToken(ctx)
+		var payload []byte
+		if err == nil && token.Value == current.Value && token.Expiry.Equal(current.Expiry) {
+			err = errTokenNotRenewed
+		}
+		if err == nil {
+			payload, err = EncodeFrame(&RenewTokenFrame{Token: token.Value})
+		}
+		if err != nil {
+			failures++
+			l.logf("relay: unable to renew token on %s: %v", hcID, err)
+			if failures >= renewFailureThreshold && l.OnTokenRenewalError != nil {
+				l.OnTokenRenewalError(&TokenRenewalError{ChannelID: hcID, Failures: failures, Expiry: expiry, Err: err})
+			}
+			timer.Reset(retryDelay(failures, expiry))
+			continue
+		}
+
+		send(respEvent{websocket.TextMessage, string(payload), nil})
+		failures = 0
+		current = token
+		expiry = token.Expiry
+		timer.Reset(renewDelay(expiry))
+	}
+}
+
+// renewDelay returns when to renew a token expiring at expiry. Tokens without a known expiry
+// are assumed to last as long as the default SAS tokens.
+func renewDelay(expiry time.Time) time.Duration {
+	lifetime := sasTokenTTL
+	if !expiry.IsZero() {
+		lifetime = time.Until(expiry)
+	}
+
+	d := time.Duration(float64(lifetime) * renewFraction)
+	d -= time.Duration(float64(d) * renewJitter * rand.Float64())
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// retryDelay returns when to retry after the given number of failed renewals, making sure a few
+// retries still happen before the token expires.
+func retryDelay(failures int, expiry time.Time) time.Duration {
+	d := renewMaxRetryDelay
+	if failures < 16 {
+		if backoff := renewRetryDelay << uint(failures-1); backoff < d {
+			d = backoff
+		}
+	}
+
+	if !expiry.IsZero() {
+		if left := time.Until(expiry) / 2; left < d {
+			d = left
+		}
+	}
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
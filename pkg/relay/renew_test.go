@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenewTokensUnchanged(t *testing.T) {
+	current := &Token{Value: "SharedAccessSignature static", Expiry: time.Now().Add(time.Second)}
+	reported := make(chan *TokenRenewalError, 1)
+	l := &Listener{
+		TokenProvider: TokenProviderFunc(func(ctx context.Context, audience string) (*Token, error) {
+			return &Token{Value: current.Value, Expiry: current.Expiry}, nil
+		}),
+		OnTokenRenewalError: func(err *TokenRenewalError) {
+			select {
+			case reported <- err:
+			default:
+			}
+		},
+	}
+
+	sent := make(chan respEvent, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go l.renewTokens(context.Background(), "id", current, func(e respEvent) { sent <- e }, done)
+
+	// the same token is not sent again every second, and fails the renewal instead
+	select {
+	case re := <-reported:
+		if !errors.Is(re, errTokenNotRenewed) || re.Failures != renewFailureThreshold {
+			t.Errorf("reported %v after %d failures, want %v after %d", re.Err, re.Failures, errTokenNotRenewed, renewFailureThreshold)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the unchanged token was never reported")
+	}
+	select {
+	case e := <-sent:
+		t.Errorf("sent %s, want no renewal of an unchanged token", e.respData)
+	default:
+	}
+}
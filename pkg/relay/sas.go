@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sasTokenTTL is the default lifetime of the SAS tokens signed with a shared access key.
+const sasTokenTTL = 3600 * time.Second
+
+// SharedAccessKeyTokenProvider signs SAS tokens with a shared access key of the namespace or
+// of the hybrid connection.
+type SharedAccessKeyTokenProvider struct {
+	KeyName string
+	Key     string
+
+	// TTL is the lifetime of the tokens. If zero, tokens are valid for an hour.
+	TTL time.Duration
+}
+
+// GetToken signs a SAS token for audience.
+func (p *SharedAccessKeyTokenProvider) GetToken(ctx context.Context, audience string) (*Token, error) {
+	if p.KeyName == "" || p.Key == "" {
+		return nil, errors.New("relay: shared access key name and key are required")
+	}
+
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = sasTokenTTL
+	}
+
+	// the token expires at the second it is signed with, not later
+	expiry := time.Unix(time.Now().Add(ttl).Unix(), 0)
+	return &Token{Value: createSASToken(audience, p.KeyName, p.Key, expiry), Expiry: expiry}, nil
+}
+
+// SharedAccessSignatureTokenProvider provides a pre-issued SAS token, so that the application
+// does not hold any key.
+type SharedAccessSignatureTokenProvider struct {
+	Signature string
+}
+
+// GetToken returns the pre-issued token, whatever the audience.
+func (p *SharedAccessSignatureTokenProvider) GetToken(ctx context.Context, audience string) (*Token, error) {
+	if p.Signature == "" {
+		return nil, errors.New("relay: shared access signature is empty")
+	}
+	return &Token{Value: p.Signature, Expiry: sasExpiry(p.Signature)}, nil
+}
+
+// createSASToken creates a shared access signature for audience, signed with the shared access
+// key named keyrule.
+func createSASToken(audience, keyrule, key string, expiry time.Time) string {
+	escapedURI := url.QueryEscape(audience)
+	var unixSecStr = fmt.Sprintf("%v", expiry.Unix())
+
+	// The string-to-sign is a unique string constructed from the fields that must be verified in order to authorize the request.
+	// The signature is an HMAC computed over the string-to-sign and key using the SHA256 algorithm, and then encoded using Base64 encoding.
+	var stringToSign = escapedURI + "\n" + unixSecStr
+	var signature = sign(key, stringToSign)
+
+	return "SharedAccessSignature sr=" + escapedURI + "&sig=" + url.QueryEscape(signature) + "&se=" + unixSecStr + "&skn=" + keyrule
+}
+
+func sign(key string, stringToSign string) string {
+	sig := hmac.New(sha256.New, []byte(key))
+	sig.Write([]byte(stringToSign))
+	sigBytes := sig.Sum(nil)
+
+	return base64.StdEncoding.EncodeToString(sigBytes)
+}
+
+// sasExpiry returns the expiry of a SAS token, or the zero time if it cannot be found.
+func sasExpiry(token string) time.Time {
+	values, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		return time.Time{}
+	}
+	se, err := strconv.ParseInt(values.Get("se"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(se, 0)
+}
+
+// audience returns the resource URI tokens are issued for, http://<namespace>/<path>.
+func audience(ns, path string) string {
+	var uri = url.URL{Scheme: "http", Host: ns, Path: path}
+	return uri.String()
+}
@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sender sends requests and opens websocket connections to an Azure Relay hybrid connection
+type Sender struct {
+	NS      string
+	Path    string
+	Keyrule string
+	Key     string
+
+	// Endpoint overrides where the relay is reached, as Listener.Endpoint.
+	Endpoint string
+
+	// SharedAccessSignature is a pre-issued SAS token used instead of signing one with Key.
+	SharedAccessSignature string
+
+	// TokenProvider provides the tokens authorizing with the relay. If nil, the tokens are
+	// SharedAccessSignature or signed with Key.
+	TokenProvider TokenProvider
+
+	// TokenInQuery sends the token in the sb-hc-token query parameter instead of the
+	// ServiceBusAuthorization header, for clients and proxies that cannot set custom headers.
+	TokenInQuery bool
+
+	// TokenTTL is the lifetime of the tokens signed with Key. If zero, tokens are valid for an hour.
+	TokenTTL time.Duration
+
+	// Query holds application query parameters added to the URIs of the requests and websocket
+	// connections of the sender, and passed through to the listener.
+	Query url.Values
+
+	// ClientAuthRequired reports whether the hybrid connection requires senders to authorize.
+	// Tokens are sent whenever credentials are set; with ClientAuthRequired, requests also fail
+	// up front when they are not.
+	ClientAuthRequired bool
+
+	// Transport is used to reach the relay over HTTPS.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Dialer opens the websocket connections to the relay.
+	// If nil, websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+}
+
+// GetRelayHTTPSURI is a function to get the uri of the hybrid connection for http requests
+func (s *Sender) GetRelayHTTPSURI(correlationID string) string {
+	return RelayURI{NS: s.NS, Endpoint: s.Endpoint, Path: s.Path, ID: correlationID, Query: s.Query}.String()
+}
+
+// GetRelayWSURI is a function to get the uri of the hybrid connection for websocket connections
+func (s *Sender) GetRelayWSURI(correlationID string) string {
+	return RelayURI{NS: s.NS, Endpoint: s.Endpoint, Path: s.Path, Action: ActionConnect, ID: correlationID, Query: s.Query}.String()
+}
+
+// CreateRelaySASToken is a function to get the sender token from its token provider.
+// It returns an empty string if the token provider fails.
+func (s *Sender) CreateRelaySASToken() string {
+	token, _ := s.getToken(context.Background())
+	return token
+}
+
+func (s *Sender) hasCredentials() bool {
+	return hasCredentials(s.TokenProvider, s.SharedAccessSignature, s.Keyrule, s.Key)
+}
+
+// getToken gets a token for the hybrid connection from the token provider.
+func (s *Sender) getToken(ctx context.Context) (string, error) {
+	t, err := defaultTokenProvider(s.TokenProvider, s.SharedAccessSignature, s.Keyrule, s.Key, s.TokenTTL).GetToken(ctx, audience(newEndpoint(s.NS, s.Endpoint).hostname(), s.Path))
+	if err != nil {
+		return "", err
+	}
+	return t.Value, nil
+}
+
+// authorize adds token to a request to the relay. If token is empty, a new one is created from
+// the credentials of the sender, if any; without credentials, the request is sent unauthorized
+// unless ClientAuthRequired is set.
+func (s *Sender) authorize(ctx context.Context, u *url.URL, header http.Header, token string) error {
+	if token == "" && !s.hasCredentials() && !s.ClientAuthRequired {
+		return nil
+	}
+	if token == "" {
+		var err error
+		if token, err = s.getToken(ctx); err != nil {
+			return err
+		}
+	}
+	setToken(u, header, token, s.TokenInQuery)
+	return nil
+}
+
+// SendRequest sends an HTTP request with the given method and body to the hybrid connection
+// and returns the response body. If sasToken is empty, a token is created from the credentials of
+// the sender, as authorize does. A response other than 2xx is returned
+// as a *RelayError if the relay answered it, such as when no listener is connected, or as a
+// *ResponseError if the listener did.
+//
+// SendRequest holds the whole response body in memory. Use Client to stream the request
+// and response bodies.
+func (s *Sender) SendRequest(method, body, sasToken string) (*[]byte, error) {
+	uri := s.GetRelayHTTPSURI("")
+
+	var bodyIO io.Reader
+	if body != "" {
+		bodyIO = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, uri, bodyIO)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.authorize(req.Context(), req.URL, req.Header, sasToken); err != nil {
+		return nil, err
+	}
+	req.Header.Add("content-type", "application/json; charset=utf-8")
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, responseError(resp, respBody)
+	}
+
+	return &respBody, nil
+}
+
+// ConnectRelayWS opens a websocket connection to the hybrid connection. If sasToken is empty,
+// a token is created from the credentials of the sender, as SendRequest does.
+func (s *Sender) ConnectRelayWS(ctx context.Context, sasToken string) (*websocket.Conn, error) {
+	u := RelayURI{NS: s.NS, Endpoint: s.Endpoint, Path: s.Path, Action: ActionConnect, Query: s.Query}.URL()
+	header := http.Header{}
+	if err := s.authorize(ctx, u, header, sasToken); err != nil {
+		return nil, err
+	}
+	c, resp, err := s.dialer().DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, newRelayError(resp, err)
+	}
+
+	return c, nil
+}
+
+func (s *Sender) dialer() *websocket.Dialer {
+	if s.Dialer != nil {
+		return s.Dialer
+	}
+	return websocket.DefaultDialer
+}
+
+// Dial opens a connection to the hybrid connection.
+func (s *Sender) Dial() (net.Conn, error) {
+	return s.DialContext(context.Background())
+}
+
+// DialContext opens a connection to the hybrid connection using the provided context.
+// The returned connection carries a byte stream over the relayed websocket; closing it
+// sends a close frame to the listener.
+func (s *Sender) DialContext(ctx context.Context) (net.Conn, error) {
+	c, err := s.ConnectRelayWS(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return newWSConn(c, c.LocalAddr(), &Addr{NS: s.NS, Path: s.Path}, nil), nil
+}
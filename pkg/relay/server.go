@@ -0,0 +1,382 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type requestFrameKey struct{}
+
+// RequestFrameFromContext returns the request frame of the relayed request served with ctx.
+func RequestFrameFromContext(ctx context.Context) (*RequestFrame, bool) {
+	f, ok := ctx.Value(requestFrameKey{}).(*RequestFrame)
+	return f, ok
+}
+
+// ListenAndServe listens on the hybrid connection and calls handler to serve the HTTP requests
+// sent to it. If handler is nil, http.DefaultServeMux is used.
+func (l *Listener) ListenAndServe(handler http.Handler) error {
+	l.Handler = handler
+	return l.Listen(context.Background())
+}
+
+// newRequest turns a request frame and its body into the request passed to the handler.
+// contentLength is -1 when the length of the body is unknown.
+func (l *Listener) newRequest(ctx context.Context, f *RequestFrame, body io.Reader, contentLength int64) (*http.Request, error) {
+	u, err := url.ParseRequestURI(f.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header(f.RequestHeaders).Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	host := header.Get("Host")
+	if host == "" {
+		host = l.NS
+	}
+	header.Del("Host")
+
+	if contentLength < 0 {
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+			contentLength = n
+		}
+	}
+
+	r := &http.Request{
+		Method:        f.Method,
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: contentLength,
+		Host:          host,
+		RemoteAddr:    f.RemoteEndpoint.String(),
+		RequestURI:    f.RequestTarget,
+	}
+	if body != nil && contentLength != 0 {
+		r.Body = io.NopCloser(body)
+	} else {
+		r.ContentLength = 0
+	}
+
+	return r.WithContext(context.WithValue(ctx, requestFrameKey{}, f)), nil
+}
+
+// maxControlMessageSize is the size of the largest request or response body carried by the
+// control channel. Larger bodies go through a rendezvous websocket.
+const maxControlMessageSize = 64 * 1024
+
+// serveRequest runs the handler for a request frame received on the control channel. The response
+// goes back on the control channel unless it outgrows it, in which case it is streamed through a
+// rendezvous websocket.
+func (l *Listener) serveRequest(ctx context.Context, f *RequestFrame, body []byte, send func(respEvent)) {
+	var rendezvous *websocket.Conn
+	defer func() {
+		if rendezvous != nil {
+			closeRendezvous(rendezvous)
+		}
+	}()
+
+	w := newResponseWriter(f.ID, func() (*websocket.Conn, error) {
+		c, _, err := l.dialer().DialContext(ctx, f.Address, nil)
+		rendezvous = c
+		return c, err
+	})
+	l.handle(ctx, w, f, bytes.NewReader(body), int64(len(body)))
+
+	frame, respBody, err := w.finish()
+	if err != nil {
+		l.logf("relay: [%s] unable to send the response: %v", f.ID, err)
+		return
+	}
+	if frame == nil {
+		// streamed through the rendezvous
+		return
+	}
+
+	send(respEvent{websocket.TextMessage, string(frame), respBody})
+}
+
+// serveRendezvous serves a request too large for the control channel. The relay only sends the
+// rendezvous address on the control channel and streams the complete request on the rendezvous
+// websocket, where the response is sent back.
+func (l *Listener) serveRendezvous(ctx context.Context, f *RequestFrame) {
+	c, _, err := l.dialer().DialContext(ctx, f.Address, nil)
+	if err != nil {
+		l.logf("relay: [%s] unable to open rendezvous for the request: %v", f.ID, err)
+		return
+	}
+	defer closeRendezvous(c)
+
+	req, body, err := readRequest(c)
+	if err != nil {
+		l.logf("relay: [%s] unable to read the request: %v", f.ID, err)
+		return
+	}
+	if req.Address == "" {
+		req.Address = f.Address
+	}
+
+	w := newResponseWriter(req.ID, func() (*websocket.Conn, error) { return c, nil })
+	l.handle(ctx, w, req, body, -1)
+
+	frame, respBody, err := w.finish()
+	if err == nil && frame != nil {
+		err = writeResponse(c, frame, respBody)
+	}
+	if err != nil {
+		l.logf("relay: [%s] unable to send the response: %v", req.ID, err)
+	}
+}
+
+// handle runs the handler for a request frame.
+func (l *Listener) handle(ctx context.Context, w *responseWriter, f *RequestFrame, body io.Reader, contentLength int64) {
+	r, err := l.newRequest(ctx, f, body, contentLength)
+	if err != nil {
+		l.logf("relay: [%s] bad request target %q: %v", f.ID, f.RequestTarget, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	l.runHandler(w, r)
+}
+
+// readRequest reads a request frame from a rendezvous websocket and returns a reader streaming its body.
+func readRequest(c *websocket.Conn) (*RequestFrame, io.Reader, error) {
+	mt, message, err := c.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if mt != websocket.TextMessage {
+		return nil, nil, errors.New("request message is not of expected type (text)")
+	}
+
+	frame, err := DecodeFrame(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, ok := frame.(*RequestFrame)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected %T on rendezvous", frame)
+	}
+
+	if !f.Body {
+		return f, nil, nil
+	}
+	_, body, err := c.NextReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, body, nil
+}
+
+// writeResponse writes a response frame and its body to a rendezvous websocket.
+func writeResponse(c *websocket.Conn, frame, body []byte) error {
+	if err := c.WriteMessage(websocket.TextMessage, frame); err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return c.WriteMessage(websocket.BinaryMessage, body)
+}
+
+func closeRendezvous(c *websocket.Conn) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.Close()
+}
+
+func (l *Listener) runHandler(w *responseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			l.logf("relay: panic serving %s: %v", r.RemoteAddr, err)
+			w.reset(http.StatusInternalServerError)
+		}
+	}()
+
+	handler := l.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(w, r)
+}
+
+var errHandlerAborted = errors.New("relay: handler aborted the response")
+
+// responseWriter buffers the response of a handler while it fits in a control message. Once it
+// outgrows the control message or the handler flushes it, the response is committed and its body
+// is streamed through a rendezvous websocket.
+type responseWriter struct {
+	requestID   string
+	header      http.Header
+	status      int
+	description string
+	wroteHeader bool
+	buf         bytes.Buffer
+
+	// sent is the header as it was when the handler wrote the status code.
+	sent http.Header
+
+	// rendezvous returns the websocket the response is streamed through.
+	rendezvous func() (*websocket.Conn, error)
+	body       io.WriteCloser
+	err        error
+}
+
+func newResponseWriter(requestID string, rendezvous func() (*websocket.Conn, error)) *responseWriter {
+	return &responseWriter{requestID: requestID, header: make(http.Header), rendezvous: rendezvous}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader records the status code and the header sent with it. Changes to the header
+// afterwards are ignored, as with net/http. Informational status codes cannot be relayed and
+// are dropped.
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if statusCode < 100 || statusCode > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", statusCode))
+	}
+	if w.wroteHeader || statusCode < 200 {
+		return
+	}
+	w.wroteHeader = true
+	w.status = statusCode
+	w.sent = w.header.Clone()
+}
+
+// SetStatusDescription sets the reason phrase sent with the status code of a response written
+// by a relay handler, such as "Not Found" in "404 Not Found". It must be called before the
+// status code is written and has no effect on other response writers.
+func SetStatusDescription(w http.ResponseWriter, description string) {
+	if rw, ok := w.(*responseWriter); ok && !rw.wroteHeader {
+		rw.description = description
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.body == nil {
+		if w.buf.Len()+len(b) <= maxControlMessageSize {
+			return w.buf.Write(b)
+		}
+		if err := w.stream(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.body.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Flush implements http.Flusher. It commits the response and sends what was written so far.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body == nil && w.err == nil {
+		w.stream()
+	}
+}
+
+// stream sends the response frame on the rendezvous websocket and starts the body message with
+// the buffered bytes.
+func (w *responseWriter) stream() error {
+	frame, err := EncodeFrame(w.frame(true))
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	c, err := w.rendezvous()
+	if err == nil {
+		err = c.WriteMessage(websocket.TextMessage, frame)
+	}
+	if err == nil {
+		w.body, err = c.NextWriter(websocket.BinaryMessage)
+	}
+	if err == nil {
+		_, err = w.body.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+
+	w.err = err
+	return err
+}
+
+// reset discards whatever the handler wrote and replaces it with an empty response.
+// A response already streamed cannot be replaced and is aborted instead.
+func (w *responseWriter) reset(statusCode int) {
+	if w.body != nil {
+		w.err = errHandlerAborted
+		return
+	}
+
+	w.header = make(http.Header)
+	w.description = ""
+	w.buf.Reset()
+	w.wroteHeader = false
+	w.WriteHeader(statusCode)
+}
+
+// finish completes the response once the handler returned. It returns the response frame and
+// body to send, or nil if the response was streamed.
+func (w *responseWriter) finish() (frame, body []byte, err error) {
+	if w.body != nil {
+		if w.err == nil {
+			// completes the body message
+			w.err = w.body.Close()
+		}
+		return nil, nil, w.err
+	}
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	frame, err = EncodeFrame(w.frame(w.buf.Len() > 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	return frame, w.buf.Bytes(), nil
+}
+
+func (w *responseWriter) frame(body bool) *ResponseFrame {
+	if w.buf.Len() > 0 && w.sent.Get("Content-Type") == "" {
+		w.sent.Set("Content-Type", http.DetectContentType(w.buf.Bytes()))
+	}
+
+	return &ResponseFrame{
+		RequestID:         w.requestID,
+		StatusCode:        w.status,
+		StatusDescription: w.description,
+		ResponseHeaders:   FrameHeader(w.sent),
+		Body:              body,
+	}
+}
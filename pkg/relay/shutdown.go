@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Shutdown gracefully shuts down the listener. It stops taking new requests and connections,
+// waits for the handlers of the requests in flight to return, closes the accepted connections
+// with a going away close frame and then closes the control channels.
+//
+// If ctx is done before the handlers return, Shutdown closes everything right away and returns
+// the context's error. Requests and connections sent during the shutdown are rejected with
+// 503 Service Unavailable.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.lazyInit()
+
+	l.mu.Lock()
+	l.shuttingDown = true
+	l.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		l.handlers.Wait()
+		close(idle)
+	}()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.conns.closeAll(websocket.CloseGoingAway)
+	l.Close()
+	return err
+}
+
+// startHandler registers a request handler with the shutdown, or reports false if the listener
+// is shutting down. The caller calls l.handlers.Done once the handler returned.
+func (l *Listener) startHandler() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shuttingDown {
+		return false
+	}
+	l.handlers.Add(1)
+	return true
+}
+
+func (l *Listener) isShuttingDown() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.shuttingDown
+}
+
+// rejectRequest answers a request received during the shutdown or while MaxConcurrentRequests
+// handlers run with 503 Service Unavailable.
+func (l *Listener) rejectRequest(f *RequestFrame, send func(respEvent)) {
+	frame, err := unavailableResponse(f.ID)
+	if err != nil {
+		l.logf("relay: [%s] unable to reject the request: %v", f.ID, err)
+		return
+	}
+	send(respEvent{websocket.TextMessage, string(frame), nil})
+}
+
+// rejectRendezvous is rejectRequest for a request too large for the control channel, answered
+// through its rendezvous websocket.
+func (l *Listener) rejectRendezvous(ctx context.Context, f *RequestFrame) {
+	c, _, err := l.dialer().DialContext(ctx, f.Address, nil)
+	if err != nil {
+		l.logf("relay: [%s] unable to open rendezvous to reject the request: %v", f.ID, err)
+		return
+	}
+	defer closeRendezvous(c)
+
+	req, _, err := readRequest(c)
+	if err == nil {
+		var frame []byte
+		if frame, err = unavailableResponse(req.ID); err == nil {
+			err = writeResponse(c, frame, nil)
+		}
+	}
+	if err != nil {
+		l.logf("relay: [%s] unable to reject the request: %v", f.ID, err)
+	}
+}
+
+func unavailableResponse(id string) ([]byte, error) {
+	return EncodeFrame(&ResponseFrame{
+		RequestID:         id,
+		StatusCode:        http.StatusServiceUnavailable,
+		StatusDescription: http.StatusText(http.StatusServiceUnavailable),
+	})
+}
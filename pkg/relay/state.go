@@ -0,0 +1,123 @@
+package relay
+
+import "time"
+
+// State is the state of the link between a listener and the relay.
+type State int
+
+const (
+	// StateOffline means the control channel is down: the listener is not opened yet, or the
+	// control channel dropped and the listener waits to reconnect it.
+	StateOffline State = iota
+
+	// StateConnecting means the listener is dialing the control channel.
+	StateConnecting
+
+	// StateOnline means the control channel is connected and the listener receives requests
+	// and connections.
+	StateOnline
+
+	// StateClosed means the listener was closed or the relay refused it for good.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateOffline:
+		return "offline"
+	case StateConnecting:
+		return "connecting"
+	case StateOnline:
+		return "online"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Status describes the state of a listener.
+type Status struct {
+	State State
+
+	// Since is when the listener entered State.
+	Since time.Time
+
+	// Err is the last error of the control channel, kept after it reconnects.
+	Err error
+}
+
+// Status returns the current state of the listener.
+func (l *Listener) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// setChannelState records the state of a control channel. The listener is online while one of
+// its control channels is, and connecting while one of them dials.
+func (l *Listener) setChannelState(index int, state State, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.channels[index] = state
+	listener := StateOffline
+	for _, s := range l.channels {
+		if s == StateOnline {
+			listener = StateOnline
+			break
+		}
+		if s == StateConnecting {
+			listener = StateConnecting
+		}
+	}
+	l.setStateLocked(listener, err)
+}
+
+// closeState moves the listener to StateClosed. err, if not nil, is the reason it closed.
+func (l *Listener) closeState(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setStateLocked(StateClosed, err)
+}
+
+// setStateLocked moves the listener to state and queues the change for OnStateChange. err, if
+// not nil, is the error that caused the change. l.mu must be held.
+func (l *Listener) setStateLocked(state State, err error) {
+	if l.status.State == StateClosed {
+		return
+	}
+	if err != nil {
+		l.status.Err = err
+	}
+	if l.status.State == state && !l.status.Since.IsZero() {
+		return
+	}
+	l.status.State = state
+	l.status.Since = time.Now()
+
+	if l.OnStateChange == nil {
+		return
+	}
+	l.statusQ = append(l.statusQ, l.status)
+	if !l.notifying {
+		l.notifying = true
+		go l.notifyStatus()
+	}
+}
+
+// notifyStatus calls OnStateChange with the queued changes, one at a time and in order.
+func (l *Listener) notifyStatus() {
+	for {
+		l.mu.Lock()
+		if len(l.statusQ) == 0 {
+			l.notifying = false
+			l.mu.Unlock()
+			return
+		}
+		s := l.statusQ[0]
+		l.statusQ = l.statusQ[1:]
+		l.mu.Unlock()
+
+		l.OnStateChange(s)
+	}
+}
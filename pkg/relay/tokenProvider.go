@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Token is a security token authorizing a listener or a sender with the relay.
+type Token struct {
+	// Value is sent as is in the ServiceBusAuthorization header, or the sb-hc-token query
+	// parameter, and the renewToken frames.
+	Value string
+
+	// Expiry is when the token expires, or the zero time if unknown.
+	Expiry time.Time
+}
+
+// TokenProvider provides the tokens authorizing a listener or a sender with the relay.
+type TokenProvider interface {
+	// GetToken returns a token for the resource URI audience, such as
+	// http://gorelay.servicebus.windows.net/yesclientauth.
+	GetToken(ctx context.Context, audience string) (*Token, error)
+}
+
+// TokenProviderFunc is an adapter to use an ordinary function as a TokenProvider.
+type TokenProviderFunc func(ctx context.Context, audience string) (*Token, error)
+
+// GetToken calls f(ctx, audience).
+func (f TokenProviderFunc) GetToken(ctx context.Context, audience string) (*Token, error) {
+	return f(ctx, audience)
+}
+
+// CommandTokenProvider returns a TokenProvider running an external command to get the tokens.
+// The command finds the audience in the RELAY_TOKEN_AUDIENCE environment variable and prints
+// the token on its standard output. The expiry of SAS tokens is read from the token.
+func CommandTokenProvider(name string, args ...string) TokenProvider {
+	return TokenProviderFunc(func(ctx context.Context, audience string) (*Token, error) {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = append(os.Environ(), "RELAY_TOKEN_AUDIENCE="+audience)
+		cmd.Stderr = &stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("relay: token command %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+
+		value := strings.TrimSpace(string(out))
+		if value == "" {
+			return nil, errors.New("relay: token command " + name + " printed no token")
+		}
+		return &Token{Value: value, Expiry: sasExpiry(value)}, nil
+	})
+}
+
+// defaultTokenProvider returns the token provider for the credentials set on a listener or a sender.
+func defaultTokenProvider(p TokenProvider, signature, keyrule, key string, ttl time.Duration) TokenProvider {
+	switch {
+	case p != nil:
+		return p
+	case signature != "":
+		return &SharedAccessSignatureTokenProvider{Signature: signature}
+	default:
+		return &SharedAccessKeyTokenProvider{KeyName: keyrule, Key: key, TTL: ttl}
+	}
+}
+
+// hasCredentials reports whether a listener or a sender is configured to get tokens. Without
+// credentials, it can only reach a relay not requiring them, such as an emulator without keys.
+func hasCredentials(p TokenProvider, signature, keyrule, key string) bool {
+	return p != nil || signature != "" || keyrule != "" || key != ""
+}
+
+// setToken attaches a token to a request to the relay, in the ServiceBusAuthorization header or,
+// if inQuery, in the sb-hc-token query parameter of u.
+func setToken(u *url.URL, header http.Header, token string, inQuery bool) {
+	if !inQuery {
+		header.Set("ServiceBusAuthorization", token)
+		return
+	}
+
+	q := u.Query()
+	q.Set("sb-hc-token", token)
+	u.RawQuery = q.Encode()
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"net/http"
+)
+
+// RoundTrip implements http.RoundTripper by sending req to the hybrid connection, so the sender
+// can be used as the Transport of an http.Client.
+//
+// Unless req already targets the relay namespace or endpoint, its scheme and host are replaced by
+// the ones of the hybrid connection, its path is appended to the hybrid connection path and the
+// Query of the sender is added to its own. A req targeting the namespace is sent to the Endpoint
+// of the sender, if set. Unless req carries a token, in its header or its query, one is added from
+// the credentials of the sender.
+func (s *Sender) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+
+	ep := newEndpoint(s.NS, s.Endpoint)
+	switch r.URL.Host {
+	case ep.host:
+	case s.NS:
+		// the namespace is reached at the endpoint
+		u := ep.httpURL("", "")
+		r.URL.Scheme, r.URL.Host = u.Scheme, u.Host
+		r.Host = ""
+	default:
+		query := r.URL.Query()
+		for name, values := range s.Query {
+			if _, ok := query[name]; !ok {
+				query[name] = values
+			}
+		}
+
+		r.URL = RelayURI{NS: s.NS, Endpoint: s.Endpoint, Path: s.Path, SubPath: r.URL.Path, Token: query.Get("sb-hc-token"), Query: query}.URL()
+		r.Host = ""
+	}
+
+	if r.Header.Get("ServiceBusAuthorization") == "" && r.URL.Query().Get("sb-hc-token") == "" {
+		if err := s.authorize(r.Context(), r.URL, r.Header, ""); err != nil {
+			closeBody(req)
+			return nil, err
+		}
+	}
+
+	transport := s.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(r)
+}
+
+// Client returns an http.Client sending its requests to the hybrid connection.
+func (s *Sender) Client() *http.Client {
+	return &http.Client{Transport: s}
+}
+
+// closeBody closes the request body, as RoundTrip must do even on errors.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
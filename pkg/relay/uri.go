@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The actions of the hybrid connection protocol, passed in the sb-hc-action query parameter.
+const (
+	ActionListen  = "listen"
+	ActionAccept  = "accept"
+	ActionConnect = "connect"
+	ActionRequest = "request"
+)
+
+// RelayURI builds the URIs of a hybrid connection: the websocket URIs of the protocol actions,
+// under $hc/<path>, and the HTTPS URIs requests are sent to, under <path>.
+type RelayURI struct {
+	// NS is the namespace of the hybrid connection.
+	NS string
+
+	// Endpoint overrides where the relay is reached, as Listener.Endpoint.
+	Endpoint string
+
+	// Path is the entity path of the hybrid connection.
+	Path string
+
+	// SubPath is appended under the entity path. A trailing slash is kept, and its dot segments
+	// are resolved so that it stays under the entity path.
+	SubPath string
+
+	// Action is one of the Action constants for a websocket URI, or empty for an HTTPS URI.
+	Action string
+
+	// ID is the sb-hc-id tracking the connection, if not empty.
+	ID string
+
+	// Token is sent in the sb-hc-token query parameter, if not empty.
+	Token string
+
+	// Query holds application query parameters passed through to the listener. The sb-hc-*
+	// parameters are reserved for the relay and are dropped from it.
+	Query url.Values
+}
+
+// URL returns the URI.
+func (u RelayURI) URL() *url.URL {
+	p := "/" + strings.Trim(u.Path, "/")
+	if sub := path.Clean("/" + u.SubPath); sub != "/" {
+		if strings.HasSuffix(u.SubPath, "/") {
+			sub += "/"
+		}
+		p = strings.TrimRight(p, "/") + sub
+	}
+
+	query := make(url.Values, len(u.Query)+3)
+	for name, values := range u.Query {
+		if !strings.HasPrefix(strings.ToLower(name), "sb-hc-") {
+			query[name] = values
+		}
+	}
+	if u.Action != "" {
+		query.Set("sb-hc-action", u.Action)
+	}
+	if u.ID != "" {
+		query.Set("sb-hc-id", u.ID)
+	}
+	if u.Token != "" {
+		query.Set("sb-hc-token", u.Token)
+	}
+
+	e := newEndpoint(u.NS, u.Endpoint)
+	if u.Action == "" {
+		return e.httpURL(p, query.Encode())
+	}
+	return e.wsURL("/$hc"+p, query.Encode())
+}
+
+// String returns the URI as a string.
+func (u RelayURI) String() string {
+	return u.URL().String()
+}
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRelayURI(t *testing.T) {
+	tests := []struct {
+		uri  RelayURI
+		want string
+	}{
+		{RelayURI{NS: "ns", Path: "hc"}, "https://ns/hc"},
+		{RelayURI{NS: "ns", Path: "/hc/"}, "https://ns/hc"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "a/b"}, "https://ns/hc/a/b"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "/a/b/"}, "https://ns/hc/a/b/"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "/"}, "https://ns/hc"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "../x"}, "https://ns/hc/x"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "/a/../../../x/./y/"}, "https://ns/hc/x/y/"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "a/.."}, "https://ns/hc"},
+		{RelayURI{NS: "ns", Path: "hc", SubPath: "a b"}, "https://ns/hc/a%20b"},
+		{RelayURI{NS: "ns", Path: "hc", Action: ActionListen, ID: "id"}, "wss://ns:443/$hc/hc?sb-hc-action=listen&sb-hc-id=id"},
+		{RelayURI{NS: "ns", Path: "hc", Action: ActionConnect, Token: "SharedAccessSignature sr=a&sig=b"},
+			"wss://ns:443/$hc/hc?sb-hc-action=connect&sb-hc-token=SharedAccessSignature+sr%3Da%26sig%3Db"},
+		{RelayURI{NS: "ns", Endpoint: "http://localhost:8080", Path: "hc", Action: ActionAccept, ID: "id"}, "ws://localhost:8080/$hc/hc?sb-hc-action=accept&sb-hc-id=id"},
+		{RelayURI{NS: "ns", Endpoint: "localhost:8443", Path: "hc"}, "https://localhost:8443/hc"},
+		{RelayURI{NS: "ns", Path: "hc", ID: "id", Query: url.Values{"a": {"1", "2"}, "sb-hc-id": {"x"}, "SB-HC-Action": {"listen"}}}, "https://ns/hc?a=1&a=2&sb-hc-id=id"},
+	}
+	for _, tt := range tests {
+		if got := tt.uri.String(); got != tt.want {
+			t.Errorf("%+v = %s, want %s", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func FuzzRelayURI(f *testing.F) {
+	f.Add(uint8(0), "id", "token", "a/b", "a", "1")
+	f.Add(uint8(1), "ca496b91-f5a3-4761-8eda-9a66dd9a2558_G17_G30", "SharedAccessSignature sr=http%3a%2f%2fns%2fhc&sig=a%2bb%3d&se=1&skn=rule", "../x", "sb-hc-id", "evil")
+	f.Add(uint8(2), "a&b=c", "#?%", "/./../../", "SB-HC-TOKEN", "evil")
+	f.Add(uint8(3), "", "", "a/../../b/", "q", "a b&c")
+	f.Add(uint8(4), "é", "\x00", "%2e%2e/x", "", "")
+
+	actions := []string{"", ActionListen, ActionAccept, ActionConnect, ActionRequest}
+	f.Fuzz(func(t *testing.T, action uint8, id, token, subPath, name, value string) {
+		uri := RelayURI{
+			NS:      "ns",
+			Path:    "hc",
+			SubPath: subPath,
+			Action:  actions[int(action)%len(actions)],
+			ID:      id,
+			Token:   token,
+			Query:   url.Values{name: {value}},
+		}
+
+		u, err := url.Parse(uri.String())
+		if err != nil {
+			t.Fatalf("%+v: %v", uri, err)
+		}
+		q := u.Query()
+
+		for param, want := range map[string]string{"sb-hc-action": uri.Action, "sb-hc-id": id, "sb-hc-token": token} {
+			if got := q.Get(param); got != want {
+				t.Errorf("%+v: %s = %q, want %q", uri, param, got, want)
+			}
+		}
+		for param := range q {
+			reserved := strings.HasPrefix(strings.ToLower(param), "sb-hc-")
+			if reserved && param != "sb-hc-action" && param != "sb-hc-id" && param != "sb-hc-token" {
+				t.Errorf("%+v: application parameter %s passed through", uri, param)
+			}
+			if !reserved && param != name {
+				t.Errorf("%+v: unexpected parameter %s", uri, param)
+			}
+		}
+		if !strings.HasPrefix(strings.ToLower(name), "sb-hc-") && q.Get(name) != value {
+			t.Errorf("%+v: %s = %q, want %q", uri, name, q.Get(name), value)
+		}
+
+		root := "/hc"
+		if uri.Action != "" {
+			root = "/$hc/hc"
+		}
+		if u.Path != root && !strings.HasPrefix(u.Path, root+"/") {
+			t.Errorf("%+v: path %s is not under %s", uri, u.Path, root)
+		}
+		for _, segment := range strings.Split(u.Path, "/") {
+			if segment == ".." {
+				t.Errorf("%+v: path %s has a dot segment", uri, u.Path)
+			}
+		}
+	})
+}
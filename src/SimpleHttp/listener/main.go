@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+)
+
+func httpReqHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		body = []byte("noBody")
+	}
+
+	var responseContent = fmt.Sprintf("Received: %s on %s from %s and body %s", r.Method, r.RequestURI, r.RemoteAddr, body)
+	resp, err := json.Marshal(map[string]string{"echo": responseContent})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println(string(resp))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+func main() {
+	// Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessKeyName=managepolicy;SharedAccessKey=...;EntityPath=yesclientauth
+	listener, err := relay.NewListener(os.Getenv("RELAY_CONNECTION_STRING"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	listener.OnStateChange = func(s relay.Status) {
+		if s.Err != nil && s.State != relay.StateOnline {
+			fmt.Printf("Listener %s: %s \n", s.State, s.Err.Error())
+			return
+		}
+		fmt.Printf("Listener %s \n", s.State)
+	}
+
+	fmt.Println("Starting...")
+
+	// shut down gracefully on SIGINT and SIGTERM
+	go func() {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := listener.Shutdown(ctx); err != nil {
+			fmt.Printf("Shutdown Error: %s \n", err.Error())
+		}
+	}()
+
+	err = listener.ListenAndServe(http.HandlerFunc(httpReqHandler))
+	if err != net.ErrClosed {
+		fmt.Printf("ListenAndServe Error: %s \n", err.Error())
+	}
+}
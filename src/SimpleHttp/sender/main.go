@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+)
+
+func main() {
+	// Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessKeyName=managepolicy;SharedAccessKey=...;EntityPath=yesclientauth
+	client, err := relay.NewSender(os.Getenv("RELAY_CONNECTION_STRING"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	sasToken := client.CreateRelaySASToken()
+	uri := client.GetRelayHTTPSURI("")
+
+	// try http GET
+	resp, err := client.SendRequest("GET", "", sasToken)
+	if err != nil {
+		fmt.Printf("Get on %s failed. Details: %s", uri, err.Error())
+	} else {
+		if resp == nil {
+			fmt.Printf("GET Response is empty!")
+		} else {
+			fmt.Printf("%s", resp)
+		}
+	}
+
+	// try http POST
+	resp, err = client.SendRequest("POST", "Hey Jude!", sasToken)
+	if err != nil {
+		fmt.Printf("POST on %s failed. Details: %s", uri, err.Error())
+	} else {
+		if resp == nil {
+			fmt.Printf("POST Response is empty!")
+		} else {
+			fmt.Printf("%s", resp)
+		}
+	}
+
+	// try an http.Client going through the relay
+	httpResp, err := client.Client().Post("http://relay/items?id=42", "text/plain", strings.NewReader("Hey Jude!"))
+	if err != nil {
+		fmt.Printf("POST on %s failed. Details: %s", uri, err.Error())
+		return
+	}
+	defer httpResp.Body.Close()
+
+	fmt.Printf("%s %s\n", httpResp.Proto, httpResp.Status)
+	io.Copy(os.Stdout, httpResp.Body)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+	"github.com/gorilla/websocket"
+)
+
+func wsReqHandler(ctx context.Context, a *relay.AcceptFrame, c *websocket.Conn) {
+	fmt.Printf("[%s] Connected from %s (%s). \n", a.ID, a.RemoteEndpoint, a.ConnectHeaders.Get("User-Agent"))
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			fmt.Printf("[%s] read Error: %s \n", a.ID, err.Error())
+			return
+		}
+
+		resp, err := json.Marshal(map[string]string{"echo": string(message)})
+		if err != nil {
+			fmt.Printf("[%s] encode Error: %s \n", a.ID, err.Error())
+			return
+		}
+		fmt.Println(string(resp))
+
+		err = c.WriteMessage(websocket.BinaryMessage, resp)
+		if err != nil {
+			fmt.Printf("[%s] write Error: %s \n", a.ID, err.Error())
+			return
+		}
+	}
+}
+
+func main() {
+	// Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessKeyName=managepolicy;SharedAccessKey=...;EntityPath=yesclientauth
+	listener, err := relay.NewListener(os.Getenv("RELAY_CONNECTION_STRING"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	listener.AcceptHandler = wsReqHandler
+
+	listener.OnStateChange = func(s relay.Status) {
+		if s.Err != nil && s.State != relay.StateOnline {
+			fmt.Printf("Listener %s: %s \n", s.State, s.Err.Error())
+			return
+		}
+		fmt.Printf("Listener %s \n", s.State)
+	}
+
+	fmt.Println("Starting...")
+
+	// shut down gracefully on SIGINT and SIGTERM
+	go func() {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := listener.Shutdown(ctx); err != nil {
+			fmt.Printf("Shutdown Error: %s \n", err.Error())
+		}
+	}()
+
+	err = listener.Listen(context.Background())
+	if err != net.ErrClosed {
+		fmt.Printf("Listen Error: %s \n", err.Error())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/BellaLi/azure-relay-GO/pkg/relay"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	// Endpoint=sb://gorelay.servicebus.windows.net/;SharedAccessKeyName=managepolicy;SharedAccessKey=...;EntityPath=yesclientauth
+	client, err := relay.NewSender(os.Getenv("RELAY_CONNECTION_STRING"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("connecting to %s", client.GetRelayWSURI(""))
+	c, err := client.DialContext(ctx)
+	if err != nil {
+		log.Fatal("dial:", err)
+	}
+	defer c.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				log.Println("read:", err)
+				stop()
+				return
+			}
+			log.Printf("recv: %s", buf[:n])
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			if _, err := c.Write([]byte(t.String())); err != nil {
+				log.Println("write:", err)
+				return
+			}
+		case <-ctx.Done():
+			log.Println("interrupt")
+			return
+		}
+	}
+}